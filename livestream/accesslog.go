@@ -0,0 +1,30 @@
+package main
+
+import "sync/atomic"
+
+// accessLogSampler decides which connect/disconnect lines get logged. With a
+// rate of N, one in every N sampled lines is written; rates below 2 log
+// everything.
+type accessLogSampler struct {
+	seen atomic.Int64
+}
+
+var accessLogs = &accessLogSampler{}
+
+// sample reports whether the next routine access log line should be written.
+func (s *accessLogSampler) sample() bool {
+	rate := int64(conf.Log.AccessSampleRate)
+	if rate < 2 {
+		return true
+	}
+	return (s.seen.Add(1)-1)%rate == 0
+}
+
+// disconnect reports whether a disconnect should be logged. Clients that had
+// events dropped because they couldn't keep up are always logged.
+func (s *accessLogSampler) disconnect(sub Subscription) bool {
+	if sub.Dropped != nil && sub.Dropped.Load() > 0 {
+		return true
+	}
+	return s.sample()
+}
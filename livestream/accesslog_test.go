@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestAccessLogSampling(t *testing.T) {
+	setConfig(t, "log.access_sample_rate", 5)
+	saved := accessLogs
+	accessLogs = &accessLogSampler{}
+	t.Cleanup(func() { accessLogs = saved })
+
+	var logs bytes.Buffer
+	e := echo.New()
+	e.Logger.SetOutput(&logs)
+	filter, _ := newTestFilter(t)
+	handler := StreamEventsHandler(filter, NewLifecycle(), NewAckRegistry(), NewSubscriptionControls())
+
+	// Each connection that hangs up at once writes a connect and a
+	// disconnect line, so 10 of them are 20 sampled lines.
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest(http.MethodGet, "/events?geo=true", nil).WithContext(ctx)
+		if err := handler(e.NewContext(req, httptest.NewRecorder())); err != nil {
+			t.Fatalf("stream returned %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		handler(e.NewContext(httptest.NewRequest(http.MethodGet, "/events", nil), httptest.NewRecorder()))
+	}
+
+	out := logs.String()
+	if got := strings.Count(out, "SSE client connected") + strings.Count(out, "SSE client disconnected"); got != 4 {
+		t.Errorf("logged %d of 20 connects and disconnects, want 1 in 5", got)
+	}
+	if got := strings.Count(out, "SSE client rejected"); got != 5 {
+		t.Errorf("logged %d of 5 rejected clients, want every one", got)
+	}
+}
+
+func TestAccessLogSlowClientDisconnects(t *testing.T) {
+	setConfig(t, "log.access_sample_rate", 1000)
+	sampler := &accessLogSampler{}
+	// Use up the one line in a thousand that is logged.
+	sampler.sample()
+
+	sub := newTestSubscription("slow", "token")
+	if sampler.disconnect(sub) {
+		t.Error("disconnect of a client that kept up escaped sampling")
+	}
+	sub.Dropped.Add(1)
+	if !sampler.disconnect(sub) {
+		t.Error("disconnect of a client that had events dropped was sampled out")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// AckRegistry holds the events sent to subscriptions in ack mode (ack=true)
+// that the client hasn't acknowledged yet. Clients ack over
+// POST /events/:id/ack, where id is the X-Subscription-ID of their stream. A
+// client that reconnects with resume=<old id> first gets its unacked events
+// again, which gives at-least-once delivery across reconnects. Acking and
+// resuming both need the JWT of the stream's project, so a stream ID seen
+// elsewhere, say in a log, can't be used to read or discard another project's
+// events.
+type AckRegistry struct {
+	mu      sync.Mutex
+	buffers map[string]*ackBuffer
+}
+
+type ackBuffer struct {
+	token   string
+	mu      sync.Mutex
+	pending []unackedEvent
+}
+
+type unackedEvent struct {
+	id      string
+	payload interface{}
+}
+
+func NewAckRegistry() *AckRegistry {
+	return &AckRegistry{buffers: make(map[string]*ackBuffer)}
+}
+
+// open creates the buffer for subscription id, whose events are for token.
+// If resumeFrom names a buffer for the same token that is still retained, its
+// unacked events are returned for redelivery.
+func (r *AckRegistry) open(id string, token string, resumeFrom string) (*ackBuffer, []interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var redeliver []interface{}
+	if previous, ok := r.buffers[resumeFrom]; ok && resumeFrom != "" && previous.token == token {
+		delete(r.buffers, resumeFrom)
+		previous.mu.Lock()
+		for _, event := range previous.pending {
+			redeliver = append(redeliver, event.payload)
+		}
+		previous.mu.Unlock()
+	}
+
+	buffer := &ackBuffer{token: token}
+	r.buffers[id] = buffer
+	return buffer, redeliver
+}
+
+// close keeps the buffer around for sse.ack_retention so that the client can
+// resume from it, then forgets it. A buffer opened under the same id since
+// is left alone.
+func (r *AckRegistry) close(id string) {
+	r.mu.Lock()
+	buffer := r.buffers[id]
+	r.mu.Unlock()
+
+	time.AfterFunc(conf.SSE.AckRetention, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.buffers[id] == buffer {
+			delete(r.buffers, id)
+		}
+	})
+}
+
+// Ack marks every event up to and including eventID as received. It reports
+// false if the subscription or the event isn't known, or the subscription
+// isn't for token.
+func (r *AckRegistry) Ack(id string, token string, eventID string) bool {
+	r.mu.Lock()
+	buffer, ok := r.buffers[id]
+	r.mu.Unlock()
+	if !ok || buffer.token != token {
+		return false
+	}
+
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	for i, event := range buffer.pending {
+		if event.id == eventID {
+			buffer.pending = buffer.pending[i+1:]
+			return true
+		}
+	}
+	return false
+}
+
+// add records a sent event. Once sse.ack_buffer_size events are unacked the
+// oldest ones are dropped.
+func (b *ackBuffer) add(id string, payload interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(b.pending, unackedEvent{id: id, payload: payload})
+	if overflow := len(b.pending) - conf.SSE.AckBufferSize; overflow > 0 {
+		b.pending = b.pending[overflow:]
+		UnackedEventsDropped.Add(float64(overflow))
+	}
+}
+
+func AckHandler(acks *AckRegistry) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := tokenFromRequest(c)
+		if err != nil {
+			var authErr *authError
+			if errors.As(err, &authErr) {
+				return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+			}
+			return err
+		}
+
+		var body struct {
+			EventID string `json:"event_id"`
+		}
+		if err := c.Bind(&body); err != nil || body.EventID == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "event_id is required")
+		}
+
+		if !acks.Ack(c.Param("id"), token, body.EventID) {
+			return echo.NewHTTPError(http.StatusNotFound, "unknown subscription or event")
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
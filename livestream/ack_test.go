@@ -0,0 +1,138 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// setConfig sets a config key for the duration of the test.
+func setConfig(t testing.TB, key string, value interface{}) {
+	t.Helper()
+	previous := viper.Get(key)
+	viper.Set(key, value)
+	decodeTestConfig(t)
+	t.Cleanup(func() {
+		viper.Set(key, previous)
+		decodeTestConfig(t)
+	})
+}
+
+// decodeTestConfig sets conf from viper, without the validation LoadConfig
+// does, since tests only set the keys they need.
+func decodeTestConfig(t testing.TB) {
+	t.Helper()
+	var config Config
+	if err := viper.Unmarshal(&config); err != nil {
+		t.Fatalf("decoding config: %v", err)
+	}
+	conf = config
+}
+
+func TestAckRegistry(t *testing.T) {
+	setConfig(t, "sse.ack_buffer_size", 3)
+	setConfig(t, "sse.ack_retention", time.Hour)
+
+	tests := []struct {
+		name          string
+		sent          []string
+		ackToken      string
+		ack           string
+		wantAcked     bool
+		resumeToken   string
+		wantRedeliver []interface{}
+	}{
+		{
+			name:          "unacked events are redelivered",
+			sent:          []string{"1", "2"},
+			resumeToken:   "token",
+			wantRedeliver: []interface{}{"1", "2"},
+		},
+		{
+			name:          "ack trims up to and including the event",
+			sent:          []string{"1", "2", "3"},
+			ackToken:      "token",
+			ack:           "2",
+			wantAcked:     true,
+			resumeToken:   "token",
+			wantRedeliver: []interface{}{"3"},
+		},
+		{
+			name:          "unknown event isn't acked",
+			sent:          []string{"1", "2"},
+			ackToken:      "token",
+			ack:           "9",
+			resumeToken:   "token",
+			wantRedeliver: []interface{}{"1", "2"},
+		},
+		{
+			name:          "oldest events are dropped past sse.ack_buffer_size",
+			sent:          []string{"1", "2", "3", "4", "5"},
+			resumeToken:   "token",
+			wantRedeliver: []interface{}{"3", "4", "5"},
+		},
+		{
+			name:          "another token can't ack",
+			sent:          []string{"1", "2"},
+			ackToken:      "other",
+			ack:           "2",
+			resumeToken:   "token",
+			wantRedeliver: []interface{}{"1", "2"},
+		},
+		{
+			name:        "another token can't resume",
+			sent:        []string{"1", "2"},
+			resumeToken: "other",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acks := NewAckRegistry()
+			buffer, _ := acks.open("old", "token", "")
+			for _, id := range tt.sent {
+				buffer.add(id, id)
+			}
+			acks.close("old")
+
+			if tt.ack != "" {
+				if acked := acks.Ack("old", tt.ackToken, tt.ack); acked != tt.wantAcked {
+					t.Errorf("Ack() = %v, want %v", acked, tt.wantAcked)
+				}
+			}
+
+			_, redeliver := acks.open("new", tt.resumeToken, "old")
+			if !slices.Equal(redeliver, tt.wantRedeliver) {
+				t.Errorf("redelivered %v, want %v", redeliver, tt.wantRedeliver)
+			}
+		})
+	}
+}
+
+func TestAckRegistryRetention(t *testing.T) {
+	setConfig(t, "sse.ack_buffer_size", 3)
+	setConfig(t, "sse.ack_retention", 10*time.Millisecond)
+
+	acks := NewAckRegistry()
+	buffer, _ := acks.open("expired", "token", "")
+	buffer.add("1", "1")
+	acks.close("expired")
+
+	// A stream that reuses its ID before the old buffer expires keeps the
+	// new buffer.
+	acks.open("reused", "token", "")
+	acks.close("reused")
+	reused, _ := acks.open("reused", "token", "")
+	reused.add("1", "1")
+
+	time.Sleep(50 * time.Millisecond)
+
+	if _, redeliver := acks.open("new", "token", "expired"); len(redeliver) != 0 {
+		t.Errorf("redelivered %v after sse.ack_retention, want nothing", redeliver)
+	}
+	if !acks.Ack("reused", "token", "1") {
+		t.Error("reopened buffer was forgotten when the old one expired")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // the runtime image has no zoneinfo of its own
+)
+
+// ActiveHours limits a subscription to a daily window of wall clock time in a
+// time zone, e.g. 09:00-17:00 in Europe/London. Times are compared on the
+// local clock, so the window follows daylight saving changes. A window whose
+// end is before its start runs overnight.
+type ActiveHours struct {
+	start    int // minutes after midnight, inclusive
+	end      int // minutes after midnight, exclusive
+	location *time.Location
+}
+
+// parseActiveHours parses an activeHours query param of the form HH:MM-HH:MM
+// along with the IANA time zone it is in. An empty window means always
+// active.
+func parseActiveHours(window string, timezone string) (*ActiveHours, error) {
+	if window == "" {
+		return nil, nil
+	}
+
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return nil, fmt.Errorf("activeHours must look like 09:00-17:00, got %q", window)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("activeHours %q is empty", window)
+	}
+
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", timezone)
+	}
+
+	return &ActiveHours{start: start, end: end, location: location}, nil
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid activeHours time %q", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether t falls in the window on the local clock.
+func (h *ActiveHours) contains(t time.Time) bool {
+	local := t.In(h.location)
+	minute := local.Hour()*60 + local.Minute()
+	if h.start < h.end {
+		return minute >= h.start && minute < h.end
+	}
+	return minute >= h.start || minute < h.end
+}
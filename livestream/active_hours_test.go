@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActiveHours(t *testing.T) {
+	tests := []struct {
+		name     string
+		window   string
+		timezone string
+		at       time.Time
+		want     bool
+	}{
+		{name: "inside", window: "09:00-17:00", at: time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC), want: true},
+		{name: "start is inclusive", window: "09:00-17:00", at: time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC), want: true},
+		{name: "end is exclusive", window: "09:00-17:00", at: time.Date(2024, 3, 4, 17, 0, 0, 0, time.UTC), want: false},
+		{name: "overnight, before midnight", window: "22:00-06:00", at: time.Date(2024, 3, 4, 23, 30, 0, 0, time.UTC), want: true},
+		{name: "overnight, after midnight", window: "22:00-06:00", at: time.Date(2024, 3, 5, 5, 59, 0, 0, time.UTC), want: true},
+		{name: "overnight, daytime", window: "22:00-06:00", at: time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC), want: false},
+		// 08:30 UTC is 09:30 in London once the clocks have gone forward.
+		{name: "in a time zone", window: "09:00-17:00", timezone: "Europe/London", at: time.Date(2024, 4, 2, 8, 30, 0, 0, time.UTC), want: true},
+		{name: "same UTC time before daylight saving", window: "09:00-17:00", timezone: "Europe/London", at: time.Date(2024, 3, 4, 8, 30, 0, 0, time.UTC), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hours, err := parseActiveHours(tt.window, tt.timezone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hours.contains(tt.at); got != tt.want {
+				t.Errorf("contains(%v) = %v, want %v", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseActiveHours(t *testing.T) {
+	if hours, err := parseActiveHours("", "Europe/London"); hours != nil || err != nil {
+		t.Errorf("parseActiveHours(\"\") = %v, %v, want always active", hours, err)
+	}
+
+	for _, tt := range []struct{ window, timezone string }{
+		{window: "09:00"},
+		{window: "9am-5pm"},
+		{window: "09:00-25:00"},
+		{window: "09:00-09:00"},
+		{window: "09:00-17:00", timezone: "Mars/Olympus_Mons"},
+	} {
+		if _, err := parseActiveHours(tt.window, tt.timezone); err == nil {
+			t.Errorf("parseActiveHours(%q, %q) succeeded, want an error", tt.window, tt.timezone)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/redis/go-redis/v9"
+)
+
+// adminAuth guards the /admin endpoints with the admin.secret bearer token.
+// Admin endpoints are disabled while no secret is configured.
+func adminAuth() echo.MiddlewareFunc {
+	return middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		secret := conf.Admin.Secret
+		if secret == "" {
+			return false, nil
+		}
+		return subtle.ConstantTimeCompare([]byte(key), []byte(secret)) == 1, nil
+	})
+}
+
+// TokenMembersResponse lists the distinct IDs currently counted for a token.
+type TokenMembersResponse struct {
+	Token     string   `json:"token"`
+	Total     int      `json:"total"`
+	Members   []string `json:"members"`
+	Truncated bool     `json:"truncated"`
+}
+
+// TokenMembersHandler returns the distinct IDs the stats keeper currently
+// counts for a token, capped at admin.max_members. With admin.hash_members
+// set, IDs are replaced by their SHA-256 so support can compare them without
+// seeing them.
+func TokenMembersHandler(teamStats *TeamStats) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := c.Param("token")
+
+		teamStats.mu.RLock()
+		users, ok := teamStats.Store[token]
+		teamStats.mu.RUnlock()
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "no stats for token")
+		}
+
+		members := users.Keys()
+		resp := TokenMembersResponse{
+			Token: token,
+			Total: len(members),
+		}
+		if maxMembers := conf.Admin.MaxMembers; len(members) > maxMembers {
+			members = members[:maxMembers]
+			resp.Truncated = true
+		}
+
+		if conf.Admin.HashMembers {
+			for i, member := range members {
+				sum := sha256.Sum256([]byte(member))
+				members[i] = hex.EncodeToString(sum[:])
+			}
+		}
+		resp.Members = members
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+type PropertyKeyCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type PropertyKeysResponse struct {
+	Token string             `json:"token"`
+	Keys  []PropertyKeyCount `json:"keys"`
+}
+
+// PropertyKeysHandler returns the property keys most often seen on a token's
+// events over the stats window, to help build filters for its stream. It
+// needs stats.property_keys.max_keys to be set; limit defaults to 20.
+func PropertyKeysHandler(teamStats *TeamStats) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if teamStats.MaxPropertyKeys <= 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "property key sampling is disabled")
+		}
+
+		limit := 20
+		if raw := c.QueryParam("limit"); raw != "" {
+			var err error
+			if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer")
+			}
+		}
+
+		token := c.Param("token")
+		teamStats.mu.RLock()
+		keys := teamStats.topPropertyKeys(token, limit, time.Now())
+		teamStats.mu.RUnlock()
+
+		return c.JSON(http.StatusOK, PropertyKeysResponse{Token: token, Keys: keys})
+	}
+}
+
+type DiagnosticsResponse struct {
+	// StatsBackend is where live stats are kept. They are always counted in
+	// process, so it is "local".
+	StatsBackend string `json:"stats_backend"`
+	// PubSub reports the Redis connection used to share events between
+	// nodes, when redis.pubsub.enabled is set.
+	PubSub    *PubSubDiagnostics `json:"pubsub,omitempty"`
+	StatsTTL  string             `json:"stats_ttl"`
+	TokenTTLs map[string]string  `json:"token_ttls,omitempty"`
+}
+
+type PubSubDiagnostics struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// DiagnosticsHandler reports how this instance keeps its stats and whether
+// its Redis connection, if any, is healthy. redisClient is nil without
+// pub/sub.
+func DiagnosticsHandler(teamStats *TeamStats, redisClient *redis.Client) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		resp := DiagnosticsResponse{
+			StatsBackend: "local",
+			StatsTTL:     teamStats.TTL.String(),
+		}
+		if len(teamStats.TokenTTLs) > 0 {
+			resp.TokenTTLs = make(map[string]string, len(teamStats.TokenTTLs))
+			for token, ttl := range teamStats.TokenTTLs {
+				resp.TokenTTLs[token] = ttl.String()
+			}
+		}
+
+		if redisClient != nil {
+			resp.PubSub = &PubSubDiagnostics{Address: redisClient.Options().Addr, Healthy: true}
+			ctx, cancel := context.WithTimeout(c.Request().Context(), 2*time.Second)
+			defer cancel()
+			if err := redisClient.Ping(ctx).Err(); err != nil {
+				resp.PubSub.Healthy = false
+				resp.PubSub.Error = err.Error()
+			}
+		}
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+type ReconnectResponse struct {
+	Token       string `json:"token"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// ReconnectTokenHandler moves a token's streams off this node, e.g. to take
+// a noisy customer's load elsewhere during an incident. Each subscriber is
+// closed at a random point within the window query param (by default
+// shutdown.drain_window) and told to reconnect; other tokens are untouched.
+func ReconnectTokenHandler(filter *Filter) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		window := conf.Shutdown.DrainWindow
+		if raw := c.QueryParam("window"); raw != "" {
+			var err error
+			if window, err = time.ParseDuration(raw); err != nil || window < 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "window must be a non-negative duration")
+			}
+		}
+
+		token := c.Param("token")
+		sent := filter.ReconnectToken(token, window)
+		c.Logger().Printf("Reconnecting %d subscribers for token %s over %v", sent, token, window)
+		return c.JSON(http.StatusOK, ReconnectResponse{Token: token, Subscribers: sent})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestTokenMembersHandler(t *testing.T) {
+	ts := newTestTeamStats()
+	ts.Store["token"] = expirable.NewLRU[string, string](10, nil, time.Hour)
+	for _, id := range []string{"alice", "bob", "carol"} {
+		ts.Store["token"].Add(id, "")
+	}
+	hash := func(id string) string {
+		sum := sha256.Sum256([]byte(id))
+		return hex.EncodeToString(sum[:])
+	}
+
+	tests := []struct {
+		name          string
+		maxMembers    int
+		hashMembers   bool
+		want          []string
+		wantTruncated bool
+	}{
+		{name: "under the cap", maxMembers: 10, want: []string{"alice", "bob", "carol"}},
+		{name: "at the cap", maxMembers: 3, want: []string{"alice", "bob", "carol"}},
+		{name: "over the cap", maxMembers: 2, want: []string{"alice", "bob"}, wantTruncated: true},
+		{name: "no members", maxMembers: 0, want: []string{}, wantTruncated: true},
+		{name: "hashed", maxMembers: 10, hashMembers: true, want: []string{hash("alice"), hash("bob"), hash("carol")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, "admin.max_members", tt.maxMembers)
+			setConfig(t, "admin.hash_members", tt.hashMembers)
+
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+			c.SetParamNames("token")
+			c.SetParamValues("token")
+			if err := TokenMembersHandler(ts)(c); err != nil {
+				t.Fatal(err)
+			}
+
+			var resp TokenMembersResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			// Members are listed oldest first.
+			if !slices.Equal(resp.Members, tt.want) {
+				t.Errorf("members = %v, want %v", resp.Members, tt.want)
+			}
+			if resp.Total != 3 || resp.Truncated != tt.wantTruncated {
+				t.Errorf("total = %d, truncated = %v, want 3, %v", resp.Total, resp.Truncated, tt.wantTruncated)
+			}
+		})
+	}
+
+	t.Run("unknown token", func(t *testing.T) {
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+		c.SetParamNames("token")
+		c.SetParamValues("unknown")
+		var httpErr *echo.HTTPError
+		if err := TokenMembersHandler(ts)(c); !errors.As(err, &httpErr) || httpErr.Code != http.StatusNotFound {
+			t.Errorf("got %v, want a 404", err)
+		}
+	})
+}
+
+func TestPropertyKeysHandler(t *testing.T) {
+	ts := newTestTeamStats()
+	ts.MaxPropertyKeys = 3
+	for _, properties := range []map[string]interface{}{
+		{"plan": "team", "$browser": "Firefox"},
+		{"plan": "team", "$browser": "Chrome", "seats": 5},
+		{"plan": "enterprise", "$browser": "Chrome", "seats": 80},
+		// The token already has 3 keys, so $os isn't counted.
+		{"$os": "Linux"},
+	} {
+		ts.add(PostHogEvent{Token: "token", DistinctId: "alice", Event: "$pageview", Properties: properties})
+	}
+
+	keys := func(target string) ([]PropertyKeyCount, error) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)
+		c.SetParamNames("token")
+		c.SetParamValues("token")
+		if err := PropertyKeysHandler(ts)(c); err != nil {
+			return nil, err
+		}
+		var resp PropertyKeysResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Keys, nil
+	}
+
+	want := []PropertyKeyCount{{Key: "$browser", Count: 3}, {Key: "plan", Count: 3}, {Key: "seats", Count: 2}}
+	if got, err := keys("/"); err != nil || !slices.Equal(got, want) {
+		t.Errorf("keys = %v, %v, want %v", got, err, want)
+	}
+	if got, err := keys("/?limit=2"); err != nil || !slices.Equal(got, want[:2]) {
+		t.Errorf("keys with limit=2 = %v, %v, want %v", got, err, want[:2])
+	}
+
+	// Once the sampled keys go quiet, new keys take their place.
+	later := time.Now().Add(2 * ts.TTL)
+	ts.addPropertyKeys("token", map[string]interface{}{"$os": "Linux"}, later)
+	if got := ts.topPropertyKeys("token", 20, later); !slices.Equal(got, []PropertyKeyCount{{Key: "$os", Count: 1}}) {
+		t.Errorf("keys after the window = %v, want only $os", got)
+	}
+
+	ts.MaxPropertyKeys = 0
+	var httpErr *echo.HTTPError
+	if _, err := keys("/"); !errors.As(err, &httpErr) || httpErr.Code != http.StatusNotFound {
+		t.Errorf("disabled sampling returned %v, want a 404", err)
+	}
+}
+
+func TestDiagnosticsHandler(t *testing.T) {
+	ts := newTestTeamStats()
+	ts.TokenTTLs = map[string]time.Duration{"busy": 5 * time.Second}
+
+	diagnostics := func(redisClient *redis.Client) DiagnosticsResponse {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		if err := DiagnosticsHandler(ts, redisClient)(c); err != nil {
+			t.Fatal(err)
+		}
+		var resp DiagnosticsResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	t.Run("local", func(t *testing.T) {
+		resp := diagnostics(nil)
+		if resp.StatsBackend != "local" || resp.PubSub != nil {
+			t.Errorf("response = %+v, want local stats and no pub/sub", resp)
+		}
+		if resp.StatsTTL != "1m0s" || resp.TokenTTLs["busy"] != "5s" {
+			t.Errorf("ttls = %s, %v, want 1m0s and busy: 5s", resp.StatsTTL, resp.TokenTTLs)
+		}
+	})
+
+	server := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+
+	t.Run("pub/sub", func(t *testing.T) {
+		resp := diagnostics(redisClient)
+		if resp.StatsBackend != "local" || resp.PubSub == nil || resp.PubSub.Address != server.Addr() || !resp.PubSub.Healthy {
+			t.Errorf("response = %+v, want local stats and healthy pub/sub at %s", resp, server.Addr())
+		}
+	})
+
+	t.Run("pub/sub down", func(t *testing.T) {
+		server.Close()
+		resp := diagnostics(redisClient)
+		if resp.PubSub == nil || resp.PubSub.Healthy || resp.PubSub.Error == "" {
+			t.Errorf("pub/sub = %+v, want it reported unhealthy", resp.PubSub)
+		}
+	})
+}
+
+func TestReconnectTokenHandler(t *testing.T) {
+	authenticateTeams(t, map[int]string{1: "phc_target", 2: "phc_other"})
+	setConfig(t, "shutdown.retry_min", time.Second)
+	setConfig(t, "shutdown.retry_max", 5*time.Second)
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent))
+	subscribed := make(subscriptionNotifier, 1)
+	filter.SetObserver(subscribed)
+	go filter.Run()
+	t.Cleanup(filter.Stop)
+	streamEvents := StreamEventsHandler(filter, NewLifecycle(), NewAckRegistry(), NewSubscriptionControls())
+
+	type stream struct {
+		rec    *flushRecorder
+		cancel context.CancelFunc
+		done   chan error
+	}
+	open := func(teamId int) stream {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		s := stream{rec: &flushRecorder{header: make(http.Header)}, cancel: cancel, done: make(chan error, 1)}
+		req := authorizeTeam(t, httptest.NewRequest(http.MethodGet, "/events", nil).WithContext(ctx), teamId)
+		go func() { s.done <- streamEvents(echo.New().NewContext(req, s.rec)) }()
+		select {
+		case <-subscribed:
+		case <-time.After(time.Second):
+			t.Fatal("stream didn't subscribe")
+		}
+		return s
+	}
+	targets := []stream{open(1), open(1)}
+	other := open(2)
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/?window=50ms", nil), rec)
+	c.SetParamNames("token")
+	c.SetParamValues("phc_target")
+	if err := ReconnectTokenHandler(filter)(c); err != nil {
+		t.Fatal(err)
+	}
+	var resp ReconnectResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Subscribers != 2 {
+		t.Errorf("reconnected %d subscribers, want the target token's 2", resp.Subscribers)
+	}
+
+	for i, s := range targets {
+		select {
+		case err := <-s.done:
+			if err != nil {
+				t.Errorf("target stream %d returned %v", i, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("target stream %d wasn't closed within the window", i)
+		}
+		s.rec.mu.Lock()
+		body := s.rec.body.String()
+		s.rec.mu.Unlock()
+		if !strings.Contains(body, "event: reconnect\n") || !strings.Contains(body, "retry: ") {
+			t.Errorf("target stream %d was sent %q, want a reconnect event with a retry", i, body)
+		}
+	}
+
+	select {
+	case err := <-other.done:
+		t.Errorf("other token's stream closed with %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	other.cancel()
+	<-other.done
+}
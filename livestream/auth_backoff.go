@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/labstack/echo/v4"
+)
+
+// authBackoff tracks failed authentications per client IP. When many tokens
+// expire at once, every client gets a 401 and retries immediately; with
+// auth.backoff.enabled, each failure tells the client to wait twice as long as
+// the last, with jitter to spread the retries, and requests arriving before
+// that are rejected without checking their token.
+type authBackoff struct {
+	mu       sync.Mutex
+	failures *simplelru.LRU[string, *authFailures]
+}
+
+type authFailures struct {
+	count int
+	until time.Time
+}
+
+var authBackoffs = newAuthBackoff(100000)
+
+func newAuthBackoff(size int) *authBackoff {
+	failures, _ := simplelru.NewLRU[string, *authFailures](size, nil)
+	return &authBackoff{failures: failures}
+}
+
+// blocked returns how much longer ip has to wait before authenticating again.
+func (b *authBackoff) blocked(ip string, now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failures, ok := b.failures.Peek(ip)
+	if !ok || !now.Before(failures.until) {
+		return 0, false
+	}
+	return failures.until.Sub(now), true
+}
+
+// fail records a failed authentication from ip and returns how long it should
+// wait before retrying. Failures are forgotten once an IP has been quiet for
+// auth.backoff.max after its last backoff ended.
+func (b *authBackoff) fail(ip string, now time.Time) time.Duration {
+	base := conf.Auth.Backoff.Base
+	limit := conf.Auth.Backoff.Max
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failures, ok := b.failures.Get(ip)
+	if !ok || now.Sub(failures.until) > limit {
+		failures = &authFailures{}
+		b.failures.Add(ip, failures)
+	}
+	failures.count++
+
+	wait := base << min(failures.count-1, 30)
+	if wait <= 0 || wait > limit {
+		wait = limit
+	}
+	// Up to half again as long, so retries spread out but still grow.
+	wait += time.Duration(rand.Int63n(int64(wait/2) + 1))
+	failures.until = now.Add(wait)
+	return wait
+}
+
+func (b *authBackoff) succeed(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures.Remove(ip)
+}
+
+// checkAuthBackoff rejects the request with a 429 if its IP is still backing
+// off after a failed authentication.
+func checkAuthBackoff(c echo.Context) error {
+	if !conf.Auth.Backoff.Enabled {
+		return nil
+	}
+	if wait, ok := authBackoffs.blocked(c.RealIP(), time.Now()); ok {
+		setRetryAfter(c, wait)
+		return echo.NewHTTPError(http.StatusTooManyRequests, "too many failed authentication attempts")
+	}
+	return nil
+}
+
+// recordAuthResult updates the backoff for the request's IP and, after a
+// failure, tells the client when to retry.
+func recordAuthResult(c echo.Context, failed bool) {
+	if !conf.Auth.Backoff.Enabled {
+		return
+	}
+	if !failed {
+		authBackoffs.succeed(c.RealIP())
+		return
+	}
+	setRetryAfter(c, authBackoffs.fail(c.RealIP(), time.Now()))
+}
+
+func setRetryAfter(c echo.Context, wait time.Duration) {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
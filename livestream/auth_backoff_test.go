@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestAuthBackoff(t *testing.T) {
+	setConfig(t, "auth.backoff.base", time.Second)
+	setConfig(t, "auth.backoff.max", time.Minute)
+
+	now := time.Now()
+	backoff := newAuthBackoff(10)
+
+	if _, blocked := backoff.blocked("1.2.3.4", now); blocked {
+		t.Fatal("blocked before any failure")
+	}
+
+	// Each failure waits twice as long as the last, plus up to half again.
+	for i, base := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		wait := backoff.fail("1.2.3.4", now)
+		if wait < base || wait > base+base/2 {
+			t.Errorf("failure %d: wait %v, want between %v and %v", i+1, wait, base, base+base/2)
+		}
+	}
+	if _, blocked := backoff.blocked("1.2.3.4", now); !blocked {
+		t.Error("not blocked after failures")
+	}
+	if _, blocked := backoff.blocked("5.6.7.8", now); blocked {
+		t.Error("another IP is blocked")
+	}
+
+	backoff.succeed("1.2.3.4")
+	if _, blocked := backoff.blocked("1.2.3.4", now); blocked {
+		t.Error("still blocked after a success")
+	}
+	if wait := backoff.fail("1.2.3.4", now); wait > time.Second+time.Second/2 {
+		t.Errorf("wait %v after a success, want the backoff to start over", wait)
+	}
+}
+
+func TestAuthBackoffIgnoresForwardedFor(t *testing.T) {
+	setConfig(t, "auth.backoff.enabled", true)
+	setConfig(t, "auth.backoff.base", time.Minute)
+	setConfig(t, "auth.backoff.max", time.Hour)
+	previous := authBackoffs
+	authBackoffs = newAuthBackoff(10)
+	t.Cleanup(func() { authBackoffs = previous })
+
+	var proxies trustedProxies
+	e := echo.New()
+	e.IPExtractor = proxies.clientIP
+	request := func(remoteAddr string, forwardedFor string) echo.Context {
+		req := httptest.NewRequest(http.MethodGet, "/events", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(echo.HeaderXForwardedFor, forwardedFor)
+		return e.NewContext(req, httptest.NewRecorder())
+	}
+
+	recordAuthResult(request("203.0.113.7:4000", "198.51.100.1"), true)
+
+	if err := checkAuthBackoff(request("203.0.113.7:4001", "198.51.100.2")); err == nil {
+		t.Error("a new X-Forwarded-For got the failing client out of its backoff")
+	}
+	if err := checkAuthBackoff(request("192.0.2.9:4000", "203.0.113.7")); err != nil {
+		t.Errorf("naming the failing client in X-Forwarded-For locked out another: %v", err)
+	}
+}
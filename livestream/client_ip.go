@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// trustedProxies are the networks whose X-Forwarded-For entries are believed.
+// Anyone can send the header, so an entry only counts if it was appended by a
+// proxy we trust.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses server.trusted_proxies. Entries are CIDRs, or
+// plain IPs for a single proxy.
+func parseTrustedProxies(entries []string) (trustedProxies, error) {
+	proxies := make(trustedProxies, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) trusts(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is an echo.IPExtractor. Starting from the peer that connected to
+// us, it walks X-Forwarded-For right to left for as long as each hop is a
+// trusted proxy, and returns the first address that isn't. Entries left of
+// that were written by the client and are ignored; with no trusted proxies,
+// the header is never read.
+func (p trustedProxies) clientIP(req *http.Request) string {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+
+	var hops []string
+	for _, header := range req.Header.Values(echo.HeaderXForwardedFor) {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(client)
+		if ip == nil || !p.trusts(ip) {
+			return client
+		}
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// A malformed entry can't be followed any further, so the
+			// trusted proxy that forwarded it is the best we know.
+			return client
+		}
+		client = hop
+	}
+	return client
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.7:4000", want: "203.0.113.7"},
+		{name: "through one proxy", remoteAddr: "10.0.0.1:4000", xff: []string{"203.0.113.7"}, want: "203.0.113.7"},
+		{name: "through a chain of proxies", remoteAddr: "10.0.0.1:4000", xff: []string{"203.0.113.7, 10.0.0.3, 10.0.0.2"}, want: "203.0.113.7"},
+		{name: "chain split over several headers", remoteAddr: "10.0.0.1:4000", xff: []string{"203.0.113.7", "10.0.0.2"}, want: "203.0.113.7"},
+		{name: "IPv6 proxy", remoteAddr: "[2001:db8::1]:4000", xff: []string{"2001:db8::7"}, want: "2001:db8::7"},
+		{name: "spoofed by a direct client", remoteAddr: "203.0.113.7:4000", xff: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "spoofed entry before the real client", remoteAddr: "10.0.0.1:4000", xff: []string{"198.51.100.1, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "spoofed trusted address before the real client", remoteAddr: "10.0.0.1:4000", xff: []string{"10.0.0.9, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "malformed entry", remoteAddr: "10.0.0.1:4000", xff: []string{"203.0.113.7, not-an-ip"}, want: "10.0.0.1"},
+		{name: "only trusted hops", remoteAddr: "10.0.0.1:4000", xff: []string{"10.0.0.2"}, want: "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/events", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.xff {
+				req.Header.Add(echo.HeaderXForwardedFor, header)
+			}
+			if got := proxies.clientIP(req); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, entry := range []string{"10.0.0", "10.0.0.0/33", "proxy.internal"} {
+		if _, err := parseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("parseTrustedProxies accepted %q", entry)
+		}
+	}
+}
+
+func TestClientIPWithoutTrustedProxies(t *testing.T) {
+	var proxies trustedProxies
+	req := httptest.NewRequest("GET", "/events", nil)
+	req.RemoteAddr = "203.0.113.7:4000"
+	req.Header.Set(echo.HeaderXForwardedFor, "198.51.100.1")
+	if got := proxies.clientIP(req); got != "203.0.113.7" {
+		t.Errorf("clientIP() = %q, want the peer address", got)
+	}
+}
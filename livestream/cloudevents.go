@@ -0,0 +1,42 @@
+package main
+
+import "time"
+
+const cloudEventType = "com.posthog.event"
+
+// CloudEvent is a CloudEvents 1.0 JSON envelope, used when a subscriber asks
+// for format=cloudevents. See https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/formats/json-format.md
+type CloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            string      `json:"time,omitempty"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+func toCloudEvent(event ResponsePostHogEvent) CloudEvent {
+	return CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              event.Uuid,
+		Source:          conf.CloudEvents.Source,
+		Type:            cloudEventType,
+		Subject:         event.Event,
+		Time:            cloudEventTime(event.Timestamp),
+		DataContentType: "application/json",
+		Data:            event,
+	}
+}
+
+// cloudEventTime returns timestamp in the RFC 3339 form the time attribute
+// requires. Timestamps come from clients, so one that doesn't parse is left
+// out rather than passed on.
+func cloudEventTime(timestamp string) string {
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
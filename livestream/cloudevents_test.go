@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestToCloudEvent(t *testing.T) {
+	setConfig(t, "cloudevents.source", "https://livestream.example.com")
+
+	tests := []struct {
+		name      string
+		timestamp string
+		wantTime  interface{}
+	}{
+		{name: "UTC", timestamp: "2024-09-01T12:00:00.123Z", wantTime: "2024-09-01T12:00:00.123Z"},
+		{name: "offset", timestamp: "2024-09-01T14:00:00+02:00", wantTime: "2024-09-01T14:00:00+02:00"},
+		{name: "not RFC 3339", timestamp: "2024-09-01 12:00:00"},
+		{name: "missing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := ResponsePostHogEvent{Uuid: "uuid", Event: "$pageview", Timestamp: tt.timestamp}
+			b, err := json.Marshal(toCloudEvent(event))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var envelope map[string]interface{}
+			if err := json.Unmarshal(b, &envelope); err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]interface{}{
+				"specversion":     "1.0",
+				"id":              "uuid",
+				"source":          "https://livestream.example.com",
+				"type":            cloudEventType,
+				"subject":         "$pageview",
+				"datacontenttype": "application/json",
+			}
+			if tt.wantTime != nil {
+				want["time"] = tt.wantTime
+			}
+			data, ok := envelope["data"].(map[string]interface{})
+			if !ok || data["uuid"] != "uuid" {
+				t.Errorf("data = %v, want the event", envelope["data"])
+			}
+			delete(envelope, "data")
+			if !reflect.DeepEqual(envelope, want) {
+				t.Errorf("envelope = %v, want %v", envelope, want)
+			}
+		})
+	}
+}
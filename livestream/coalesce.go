@@ -0,0 +1,46 @@
+package main
+
+import "time"
+
+// coalescer collapses consecutive events with the same name and distinct_id
+// that arrive within a window into the latest one, counting how many were
+// folded together. It's used by subscriptions that opt in with coalesce=true
+// to tame flapping events such as $pageview/$pageleave.
+type coalescer struct {
+	window  time.Duration
+	timer   *time.Timer
+	pending *ResponsePostHogEvent
+}
+
+func newCoalescer(window time.Duration) *coalescer {
+	timer := time.NewTimer(window)
+	timer.Stop()
+	return &coalescer{window: window, timer: timer}
+}
+
+// add buffers event. If a different event was pending it is returned so the
+// caller can send it straight away.
+func (co *coalescer) add(event ResponsePostHogEvent) *ResponsePostHogEvent {
+	if co.pending != nil && co.pending.Event == event.Event && co.pending.DistinctId == event.DistinctId {
+		event.Count = co.pending.Count + 1
+		co.pending = &event
+		return nil
+	}
+
+	flushed := co.pending
+	event.Count = 1
+	co.pending = &event
+	co.timer.Reset(co.window)
+	return flushed
+}
+
+// take returns and clears the pending event once the window has elapsed.
+func (co *coalescer) take() *ResponsePostHogEvent {
+	pending := co.pending
+	co.pending = nil
+	return pending
+}
+
+func (co *coalescer) stop() {
+	co.timer.Stop()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCoalescer(t *testing.T) {
+	co := newCoalescer(10 * time.Millisecond)
+	defer co.stop()
+
+	var sent []string
+	send := func(event *ResponsePostHogEvent) {
+		if event != nil {
+			sent = append(sent, fmt.Sprintf("%s/%s/%s x%d", event.Event, event.DistinctId, event.Uuid, event.Count))
+		}
+	}
+
+	// $pageview and $pageleave flapping for one user collapse into the latest
+	// of each run; anything different is passed on as is.
+	for _, event := range []ResponsePostHogEvent{
+		{Uuid: "1", Event: "$pageview", DistinctId: "alice"},
+		{Uuid: "2", Event: "$pageview", DistinctId: "alice"},
+		{Uuid: "3", Event: "$pageview", DistinctId: "alice"},
+		{Uuid: "4", Event: "$pageleave", DistinctId: "alice"},
+		{Uuid: "5", Event: "$pageleave", DistinctId: "bob"},
+	} {
+		send(co.add(event))
+	}
+
+	select {
+	case <-co.timer.C:
+		send(co.take())
+	case <-time.After(time.Second):
+		t.Fatal("window never elapsed")
+	}
+
+	want := []string{"$pageview/alice/3 x3", "$pageleave/alice/4 x1", "$pageleave/bob/5 x1"}
+	if !slices.Equal(sent, want) {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+	if co.take() != nil {
+		t.Error("an event was still pending after the window")
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Config is the typed view of every setting the service reads. It is loaded
+// once at startup by LoadConfig so that missing, out-of-range or misspelled
+// settings fail fast instead of silently falling back to defaults.
+//
+// Older config files may still hold keys that have since been retired. They
+// are accepted with a warning rather than rejected; see warnDeprecated.
+type Config struct {
+	Prod bool `mapstructure:"prod"`
+
+	// Deprecated: tailscale is no longer read.
+	Tailscale map[string]interface{} `mapstructure:"tailscale"`
+
+	Sentry struct {
+		DSN string `mapstructure:"dsn"`
+	} `mapstructure:"sentry"`
+
+	Kafka struct {
+		Brokers string `mapstructure:"brokers"`
+		Topic   string `mapstructure:"topic"`
+		GroupID string `mapstructure:"group_id"`
+	} `mapstructure:"kafka"`
+
+	MMDB struct {
+		Path string `mapstructure:"path"`
+	} `mapstructure:"mmdb"`
+
+	JWT struct {
+		Secret string `mapstructure:"secret"`
+		// Deprecated: Token is the old name of Secret.
+		Token                   string        `mapstructure:"token"`
+		Secrets                 []string      `mapstructure:"secrets"`
+		CookieName              string        `mapstructure:"cookie_name"`
+		AudienceCaseInsensitive bool          `mapstructure:"audience_case_insensitive"`
+		NearExpiryThreshold     time.Duration `mapstructure:"near_expiry_threshold"`
+		Issuers                 []JWTIssuer   `mapstructure:"issuers"`
+	} `mapstructure:"jwt"`
+
+	Auth struct {
+		TokenPattern string `mapstructure:"token_pattern"`
+		Backoff      struct {
+			Enabled bool          `mapstructure:"enabled"`
+			Base    time.Duration `mapstructure:"base"`
+			Max     time.Duration `mapstructure:"max"`
+		} `mapstructure:"backoff"`
+	} `mapstructure:"auth"`
+
+	Server struct {
+		TrustedProxies    []string      `mapstructure:"trusted_proxies"`
+		MaxBodyBytes      int64         `mapstructure:"max_body_bytes"`
+		ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
+	} `mapstructure:"server"`
+
+	Postgres struct {
+		URL string `mapstructure:"url"`
+	} `mapstructure:"postgres"`
+
+	Redis struct {
+		Address string `mapstructure:"address"`
+		PubSub  struct {
+			Enabled   bool `mapstructure:"enabled"`
+			QueueSize int  `mapstructure:"queue_size"`
+		} `mapstructure:"pubsub"`
+	} `mapstructure:"redis"`
+
+	Admin struct {
+		Secret      string `mapstructure:"secret"`
+		MaxMembers  int    `mapstructure:"max_members"`
+		HashMembers bool   `mapstructure:"hash_members"`
+	} `mapstructure:"admin"`
+
+	Stats struct {
+		TTL                  time.Duration `mapstructure:"ttl"`
+		MaxTTL               time.Duration `mapstructure:"max_ttl"`
+		MaxEventNames        int           `mapstructure:"max_event_names"`
+		StreamInterval       time.Duration `mapstructure:"stream_interval"`
+		GracePeriod          time.Duration `mapstructure:"grace_period"`
+		PeakWindow           time.Duration `mapstructure:"peak_window"`
+		ActiveTokensInterval time.Duration `mapstructure:"active_tokens_interval"`
+		DistinctIDs          struct {
+			Trim      bool `mapstructure:"trim"`
+			Lowercase bool `mapstructure:"lowercase"`
+		} `mapstructure:"distinct_ids"`
+		TokenTTLs []struct {
+			Token string        `mapstructure:"token"`
+			TTL   time.Duration `mapstructure:"ttl"`
+		} `mapstructure:"token_ttls"`
+		PropertyKeys struct {
+			MaxKeys int `mapstructure:"max_keys"`
+		} `mapstructure:"property_keys"`
+		TokenGroups []struct {
+			Tokens []string `mapstructure:"tokens"`
+		} `mapstructure:"token_groups"`
+	} `mapstructure:"stats"`
+
+	Log struct {
+		AccessSampleRate int `mapstructure:"access_sample_rate"`
+	} `mapstructure:"log"`
+
+	Metrics struct {
+		TokenBuckets int    `mapstructure:"token_buckets"`
+		Namespace    string `mapstructure:"namespace"`
+	} `mapstructure:"metrics"`
+
+	Ingestion struct {
+		QueueSize      int    `mapstructure:"queue_size"`
+		OverflowPolicy string `mapstructure:"overflow_policy"`
+	} `mapstructure:"ingestion"`
+
+	Replay struct {
+		BufferSize  int           `mapstructure:"buffer_size"`
+		MaxTokens   int           `mapstructure:"max_tokens"`
+		IdleTTL     time.Duration `mapstructure:"idle_ttl"`
+		MaxBytes    int           `mapstructure:"max_bytes"`
+		MaxAge      time.Duration `mapstructure:"max_age"`
+		SequenceIDs bool          `mapstructure:"sequence_ids"`
+	} `mapstructure:"replay"`
+
+	Filter struct {
+		TokenlessEvents string   `mapstructure:"tokenless_events"`
+		AlwaysDeliver   []string `mapstructure:"always_deliver"`
+	} `mapstructure:"filter"`
+
+	Filters struct {
+		MaxRegexLength int `mapstructure:"max_regex_length"`
+		MaxPathDepth   int `mapstructure:"max_path_depth"`
+		MaxGroupDepth  int `mapstructure:"max_group_depth"`
+		MaxConditions  int `mapstructure:"max_conditions"`
+	} `mapstructure:"filters"`
+
+	Transforms struct {
+		Redact struct {
+			Allowlist []string `mapstructure:"allowlist"`
+			Blocklist []string `mapstructure:"blocklist"`
+		} `mapstructure:"redact"`
+	} `mapstructure:"transforms"`
+
+	SSE struct {
+		MaxConnections    int64         `mapstructure:"max_connections"`
+		RetryAfter        int           `mapstructure:"retry_after"`
+		ReconnectAfter    time.Duration `mapstructure:"reconnect_after"`
+		IdleTimeout       time.Duration `mapstructure:"idle_timeout"`
+		CoalesceWindow    time.Duration `mapstructure:"coalesce_window"`
+		OrderWindow       time.Duration `mapstructure:"order_window"`
+		AckBufferSize     int           `mapstructure:"ack_buffer_size"`
+		AckRetention      time.Duration `mapstructure:"ack_retention"`
+		FlushInterval     time.Duration `mapstructure:"flush_interval"`
+		FlushMaxEvents    int           `mapstructure:"flush_max_events"`
+		PauseBufferSize   int           `mapstructure:"pause_buffer_size"`
+		AuthFailure       string        `mapstructure:"auth_failure"`
+		HeartbeatInterval time.Duration `mapstructure:"heartbeat_interval"`
+		MaxHeaderBytes    int           `mapstructure:"max_header_bytes"`
+		MaxQueryLength    int           `mapstructure:"max_query_length"`
+	} `mapstructure:"sse"`
+
+	WebSocket struct {
+		AllowedOrigins []string `mapstructure:"allowed_origins"`
+	} `mapstructure:"websocket"`
+
+	Webhook struct {
+		BufferSize    int           `mapstructure:"buffer_size"`
+		BatchSize     int           `mapstructure:"batch_size"`
+		FlushInterval time.Duration `mapstructure:"flush_interval"`
+		Timeout       time.Duration `mapstructure:"timeout"`
+		MaxRetries    int           `mapstructure:"max_retries"`
+		RetryBackoff  time.Duration `mapstructure:"retry_backoff"`
+		Sinks         []struct {
+			Token      string   `mapstructure:"token"`
+			URL        string   `mapstructure:"url"`
+			EventTypes []string `mapstructure:"event_types"`
+			DistinctId string   `mapstructure:"distinct_id"`
+			Properties string   `mapstructure:"properties"`
+		} `mapstructure:"sinks"`
+	} `mapstructure:"webhook"`
+
+	Startup struct {
+		DelayMin time.Duration `mapstructure:"delay_min"`
+		DelayMax time.Duration `mapstructure:"delay_max"`
+	} `mapstructure:"startup"`
+
+	Shutdown struct {
+		Timeout     time.Duration `mapstructure:"timeout"`
+		DrainWindow time.Duration `mapstructure:"drain_window"`
+		RetryMin    time.Duration `mapstructure:"retry_min"`
+		RetryMax    time.Duration `mapstructure:"retry_max"`
+	} `mapstructure:"shutdown"`
+
+	CloudEvents struct {
+		Source string `mapstructure:"source"`
+	} `mapstructure:"cloudevents"`
+
+	Instance struct {
+		ID              string `mapstructure:"id"`
+		IncludeInEvents bool   `mapstructure:"include_in_events"`
+	} `mapstructure:"instance"`
+}
+
+// JWTIssuer is an entry of jwt.issuers: an issuer whose tokens are accepted
+// and the secret they are signed with.
+type JWTIssuer struct {
+	Issuer string `mapstructure:"issuer"`
+	Secret string `mapstructure:"secret"`
+}
+
+var metricNamespacePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// conf holds the settings in effect. main sets it from LoadConfig at startup;
+// until then, as in tests, it is the zero Config.
+var conf Config
+
+// LoadConfig decodes the settings read by loadConfigs into a Config and
+// validates them. Unknown keys are rejected, so a misspelled setting is
+// reported rather than ignored. Every problem found is returned, not just the
+// first.
+func LoadConfig() (*Config, error) {
+	var config Config
+	if err := viper.UnmarshalExact(&config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	config.warnDeprecated()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// warnDeprecated logs every retired key the config still sets, and carries
+// the value of a renamed key over to its new name unless that is set too.
+func (c *Config) warnDeprecated() {
+	if c.Tailscale != nil {
+		log.Printf("Config: tailscale is no longer read and can be removed")
+	}
+	if c.JWT.Token != "" {
+		log.Printf("Config: jwt.token is deprecated, use jwt.secret instead")
+		if c.JWT.Secret == "" {
+			c.JWT.Secret = c.JWT.Token
+		}
+	}
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Kafka.Brokers != "", "kafka.brokers must be set")
+	check(c.Kafka.Topic != "", "kafka.topic must be set")
+	check(c.Kafka.GroupID != "", "kafka.group_id must be set")
+	check(c.MMDB.Path != "", "mmdb.path must be set")
+	check(c.JWT.Secret != "" || len(c.JWT.Secrets) > 0 || len(c.JWT.Issuers) > 0,
+		"one of jwt.secret, jwt.secrets or jwt.issuers must be set")
+	for i, issuer := range c.JWT.Issuers {
+		check(issuer.Issuer != "" && issuer.Secret != "", "jwt.issuers[%d]: issuer and secret must be set", i)
+	}
+	if _, err := regexp.Compile(c.Auth.TokenPattern); err != nil {
+		check(false, "auth.token_pattern: %v", err)
+	}
+	check(c.Auth.Backoff.Base > 0 && c.Auth.Backoff.Base <= c.Auth.Backoff.Max,
+		"auth.backoff.base (%v) must be positive and no longer than auth.backoff.max (%v)", c.Auth.Backoff.Base, c.Auth.Backoff.Max)
+	check(!c.Redis.PubSub.Enabled || c.Redis.Address != "", "redis.address must be set when redis.pubsub.enabled is true")
+	check(c.Redis.PubSub.QueueSize > 0, "redis.pubsub.queue_size must be positive, got %d", c.Redis.PubSub.QueueSize)
+
+	if _, err := parseTrustedProxies(c.Server.TrustedProxies); err != nil {
+		check(false, "server.trusted_proxies: %v", err)
+	}
+
+	check(c.Server.ReadHeaderTimeout >= 0, "server.read_header_timeout must not be negative, got %v", c.Server.ReadHeaderTimeout)
+	check(c.Server.MaxBodyBytes >= 0, "server.max_body_bytes must not be negative, got %d", c.Server.MaxBodyBytes)
+
+	check(c.Admin.MaxMembers >= 0, "admin.max_members must not be negative, got %d", c.Admin.MaxMembers)
+
+	check(c.Stats.TTL > 0, "stats.ttl must be positive, got %v", c.Stats.TTL)
+	check(c.Stats.MaxTTL >= 0, "stats.max_ttl must not be negative, got %v", c.Stats.MaxTTL)
+	check(c.Stats.ActiveTokensInterval > 0, "stats.active_tokens_interval must be positive, got %v", c.Stats.ActiveTokensInterval)
+	check(c.Stats.GracePeriod >= 0, "stats.grace_period must not be negative, got %v", c.Stats.GracePeriod)
+	check(c.Stats.PeakWindow > 0, "stats.peak_window must be positive, got %v", c.Stats.PeakWindow)
+	check(c.Stats.StreamInterval > 0, "stats.stream_interval must be positive, got %v", c.Stats.StreamInterval)
+	check(c.Stats.MaxEventNames > 0, "stats.max_event_names must be positive, got %d", c.Stats.MaxEventNames)
+	for i, override := range c.Stats.TokenTTLs {
+		check(override.Token != "" && override.TTL > 0, "stats.token_ttls[%d]: token and a positive ttl must be set", i)
+	}
+
+	check(c.Stats.PropertyKeys.MaxKeys >= 0, "stats.property_keys.max_keys must not be negative, got %d", c.Stats.PropertyKeys.MaxKeys)
+	grouped := make(map[string]bool)
+	for i, group := range c.Stats.TokenGroups {
+		check(len(group.Tokens) >= 2, "stats.token_groups[%d]: a group needs at least two tokens", i)
+		for _, token := range group.Tokens {
+			check(!grouped[token], "stats.token_groups[%d]: token %s is already in another group", i, token)
+			grouped[token] = true
+		}
+	}
+
+	check(c.Metrics.Namespace == "" || metricNamespacePattern.MatchString(c.Metrics.Namespace),
+		"metrics.namespace must be a valid Prometheus name, got %q", c.Metrics.Namespace)
+	check(c.Metrics.TokenBuckets > 0 && c.Metrics.TokenBuckets <= 1000,
+		"metrics.token_buckets must be between 1 and 1000, got %d", c.Metrics.TokenBuckets)
+
+	check(c.Ingestion.QueueSize > 0, "ingestion.queue_size must be positive, got %d", c.Ingestion.QueueSize)
+	check(c.Ingestion.OverflowPolicy == OverflowBlock || c.Ingestion.OverflowPolicy == OverflowDropOldest || c.Ingestion.OverflowPolicy == OverflowDropNewest,
+		"ingestion.overflow_policy must be block, drop_oldest or drop_newest, got %q", c.Ingestion.OverflowPolicy)
+
+	check(c.Replay.BufferSize >= 0, "replay.buffer_size must not be negative, got %d", c.Replay.BufferSize)
+	check(c.Replay.MaxAge >= 0, "replay.max_age must not be negative, got %v", c.Replay.MaxAge)
+	check(c.Replay.MaxTokens >= 0, "replay.max_tokens must not be negative, got %d", c.Replay.MaxTokens)
+	check(c.Replay.IdleTTL >= 0, "replay.idle_ttl must not be negative, got %v", c.Replay.IdleTTL)
+	check(c.Replay.MaxBytes >= 0, "replay.max_bytes must not be negative, got %d", c.Replay.MaxBytes)
+	check(c.Filters.MaxRegexLength > 0, "filters.max_regex_length must be positive, got %d", c.Filters.MaxRegexLength)
+	check(c.Filters.MaxPathDepth > 0, "filters.max_path_depth must be positive, got %d", c.Filters.MaxPathDepth)
+	check(c.Filters.MaxGroupDepth > 0, "filters.max_group_depth must be positive, got %d", c.Filters.MaxGroupDepth)
+	check(c.Filters.MaxConditions > 0, "filters.max_conditions must be positive, got %d", c.Filters.MaxConditions)
+	check(c.Filter.TokenlessEvents == "drop" || c.Filter.TokenlessEvents == "route",
+		"filter.tokenless_events must be drop or route, got %q", c.Filter.TokenlessEvents)
+
+	check(c.SSE.MaxConnections >= 0, "sse.max_connections must not be negative, got %d", c.SSE.MaxConnections)
+	check(c.SSE.MaxHeaderBytes >= 0, "sse.max_header_bytes must not be negative, got %d", c.SSE.MaxHeaderBytes)
+	check(c.SSE.MaxQueryLength >= 0, "sse.max_query_length must not be negative, got %d", c.SSE.MaxQueryLength)
+	check(c.SSE.AckBufferSize > 0, "sse.ack_buffer_size must be positive, got %d", c.SSE.AckBufferSize)
+	check(c.SSE.PauseBufferSize > 0, "sse.pause_buffer_size must be positive, got %d", c.SSE.PauseBufferSize)
+	check(c.SSE.CoalesceWindow > 0, "sse.coalesce_window must be positive, got %v", c.SSE.CoalesceWindow)
+	check(c.SSE.OrderWindow > 0, "sse.order_window must be positive, got %v", c.SSE.OrderWindow)
+	check(c.SSE.AuthFailure == "status" || c.SSE.AuthFailure == "event",
+		"sse.auth_failure must be status or event, got %q", c.SSE.AuthFailure)
+	for _, origin := range c.WebSocket.AllowedOrigins {
+		u, err := url.Parse(origin)
+		check(err == nil && u.Scheme != "" && u.Host != "" && u.Path == "",
+			"websocket.allowed_origins: %q must be a scheme and host, such as https://app.example.com", origin)
+	}
+
+	check(c.Webhook.BufferSize > 0, "webhook.buffer_size must be positive, got %d", c.Webhook.BufferSize)
+	check(c.Webhook.BatchSize > 0, "webhook.batch_size must be positive, got %d", c.Webhook.BatchSize)
+	check(c.Webhook.FlushInterval > 0, "webhook.flush_interval must be positive, got %v", c.Webhook.FlushInterval)
+	check(c.Webhook.MaxRetries >= 0, "webhook.max_retries must not be negative, got %d", c.Webhook.MaxRetries)
+
+	check(c.Startup.DelayMin >= 0 && c.Startup.DelayMin <= c.Startup.DelayMax,
+		"startup.delay_min (%v) must not be negative or exceed startup.delay_max (%v)", c.Startup.DelayMin, c.Startup.DelayMax)
+
+	check(c.Shutdown.Timeout > 0, "shutdown.timeout must be positive, got %v", c.Shutdown.Timeout)
+	check(c.Shutdown.DrainWindow < c.Shutdown.Timeout,
+		"shutdown.drain_window (%v) must be shorter than shutdown.timeout (%v)", c.Shutdown.DrainWindow, c.Shutdown.Timeout)
+	check(c.Shutdown.RetryMin <= c.Shutdown.RetryMax,
+		"shutdown.retry_min (%v) must not exceed shutdown.retry_max (%v)", c.Shutdown.RetryMin, c.Shutdown.RetryMax)
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// loadTestConfig loads the defaults plus settings, the way LoadConfig would
+// after reading a config file holding them.
+func loadTestConfig(t *testing.T, settings map[string]interface{}) (*Config, error) {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	setConfigDefaults()
+	required := map[string]interface{}{
+		"kafka.brokers": "localhost:9092",
+		"kafka.topic":   "events",
+		"mmdb.path":     "GeoLite2-City.mmdb",
+		"jwt.secret":    "secret",
+	}
+	for key, value := range required {
+		viper.Set(key, value)
+	}
+	for key, value := range settings {
+		viper.Set(key, value)
+	}
+	return LoadConfig()
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		wantErrs []string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name:     "misspelled key",
+			settings: map[string]interface{}{"sse.max_conections": 10},
+			wantErrs: []string{"max_conections"},
+		},
+		{
+			name:     "wrong type",
+			settings: map[string]interface{}{"stats.ttl": "soon"},
+			wantErrs: []string{"stats.ttl"},
+		},
+		{
+			name: "every problem is reported",
+			settings: map[string]interface{}{
+				"ingestion.overflow_policy": "drop_all",
+				"sse.max_connections":       -1,
+			},
+			wantErrs: []string{"ingestion.overflow_policy", "sse.max_connections"},
+		},
+		{
+			name:     "invalid token pattern",
+			settings: map[string]interface{}{"auth.token_pattern": "phc_[a-z"},
+			wantErrs: []string{"auth.token_pattern"},
+		},
+		{
+			name:     "issuer without a secret",
+			settings: map[string]interface{}{"jwt.issuers": []map[string]interface{}{{"issuer": "eu"}}},
+			wantErrs: []string{"jwt.issuers[0]"},
+		},
+		{
+			name:     "origin with a path",
+			settings: map[string]interface{}{"websocket.allowed_origins": []string{"https://app.example.com/embed"}},
+			wantErrs: []string{"websocket.allowed_origins"},
+		},
+		{
+			name:     "negative member cap",
+			settings: map[string]interface{}{"admin.max_members": -1},
+			wantErrs: []string{"admin.max_members"},
+		},
+		{
+			name:     "startup delay range",
+			settings: map[string]interface{}{"startup.delay_min": "10s", "startup.delay_max": "5s"},
+			wantErrs: []string{"startup.delay_min"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.settings)
+			if len(tt.wantErrs) == 0 {
+				if err != nil {
+					t.Fatalf("LoadConfig() error: %v", err)
+				}
+				if config.Kafka.GroupID != "livestream" {
+					t.Errorf("kafka.group_id = %q, want the default", config.Kafka.GroupID)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("LoadConfig() succeeded, want an error")
+			}
+			for _, want := range tt.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("LoadConfig() error %q doesn't mention %s", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigDeprecatedKeys(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]interface{}{
+		"jwt.secret":         "",
+		"jwt.token":          "old secret",
+		"tailscale.hostname": "live-events-dev",
+	})
+	if err != nil {
+		t.Fatalf("LoadConfig() rejected a config using retired keys: %v", err)
+	}
+	if config.JWT.Secret != "old secret" {
+		t.Errorf("jwt.secret = %q, want the value of jwt.token", config.JWT.Secret)
+	}
+
+	config, err = loadTestConfig(t, map[string]interface{}{"jwt.token": "old secret"})
+	if err != nil {
+		t.Fatalf("LoadConfig() error: %v", err)
+	}
+	if config.JWT.Secret != "secret" {
+		t.Errorf("jwt.secret = %q, want it to win over jwt.token", config.JWT.Secret)
+	}
+}
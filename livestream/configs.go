@@ -14,13 +14,12 @@ func loadConfigs() {
 	viper.SetConfigName("configs")
 	viper.AddConfigPath("configs/")
 
-	viper.SetDefault("kafka.group_id", "livestream")
-	viper.SetDefault("prod", false)
+	setConfigDefaults()
 
 	err := viper.ReadInConfig()
 	if err != nil {
 		sentry.CaptureException(err)
-		log.Fatalf("fatal error config file: %w", err)
+		log.Fatalf("fatal error config file: %v", err)
 	}
 
 	viper.OnConfigChange(func(e fsnotify.Event) {
@@ -31,6 +30,84 @@ func loadConfigs() {
 	viper.SetEnvPrefix("livestream") // will be uppercased automatically
 	replacer := strings.NewReplacer(".", "_")
 	viper.SetEnvKeyReplacer(replacer)
-	viper.BindEnv("jwt.secret")   // read from LIVESTREAM_JWT_SECRET
-	viper.BindEnv("postgres.url") // read from LIVESTREAM_POSTGRES_URL
+	viper.BindEnv("jwt.secret")    // read from LIVESTREAM_JWT_SECRET
+	viper.BindEnv("postgres.url")  // read from LIVESTREAM_POSTGRES_URL
+	viper.BindEnv("redis.address") // read from LIVESTREAM_REDIS_ADDRESS
+	viper.BindEnv("admin.secret")  // read from LIVESTREAM_ADMIN_SECRET
+	viper.BindEnv("instance.id")   // read from LIVESTREAM_INSTANCE_ID
+}
+
+// setConfigDefaults sets the default for every setting that has one.
+func setConfigDefaults() {
+	viper.SetDefault("kafka.group_id", "livestream")
+	viper.SetDefault("prod", false)
+	viper.SetDefault("jwt.audience_case_insensitive", false)
+	viper.SetDefault("jwt.near_expiry_threshold", "1m")
+	viper.SetDefault("auth.backoff.enabled", false)
+	viper.SetDefault("auth.backoff.base", "1s")
+	viper.SetDefault("auth.backoff.max", "5m")
+	viper.SetDefault("server.trusted_proxies", []string{}) // CIDRs or IPs, empty ignores X-Forwarded-For
+	viper.SetDefault("server.read_header_timeout", "10s")  // 0 waits for headers forever
+	viper.SetDefault("server.max_body_bytes", 65536)       // 0 disables the limit
+	viper.SetDefault("stats.ttl", "30s")
+	viper.SetDefault("stats.max_ttl", "24h")
+	viper.SetDefault("stats.max_event_names", 100)
+	viper.SetDefault("stats.stream_interval", "5s")
+	viper.SetDefault("stats.peak_window", "24h")
+	viper.SetDefault("stats.property_keys.max_keys", 0) // e.g. 100, 0 disables property key sampling
+	viper.SetDefault("stats.grace_period", 0)           // e.g. "10s", 0 counts users on their first event
+	viper.SetDefault("stats.active_tokens_interval", "30s")
+	viper.SetDefault("stats.distinct_ids.trim", false)
+	viper.SetDefault("stats.distinct_ids.lowercase", false)
+	viper.SetDefault("log.access_sample_rate", 1)
+	viper.SetDefault("metrics.token_buckets", 256)
+	viper.SetDefault("metrics.namespace", "") // e.g. "posthog" to expose posthog_livestream_* metrics
+	viper.SetDefault("webhook.buffer_size", 1000)
+	viper.SetDefault("webhook.batch_size", 100)
+	viper.SetDefault("webhook.flush_interval", "1s")
+	viper.SetDefault("webhook.timeout", "10s")
+	viper.SetDefault("webhook.max_retries", 3)
+	viper.SetDefault("webhook.retry_backoff", "500ms")
+	viper.SetDefault("ingestion.queue_size", 10000)
+	viper.SetDefault("ingestion.overflow_policy", "block") // or "drop_oldest", "drop_newest"
+	viper.SetDefault("replay.buffer_size", 100)
+	viper.SetDefault("replay.max_tokens", 1000)
+	viper.SetDefault("replay.idle_ttl", "10m")
+	viper.SetDefault("replay.max_bytes", 64<<20) // estimated size of all buffers, 0 for no limit
+	viper.SetDefault("replay.sequence_ids", false)
+	viper.SetDefault("replay.max_age", 0) // e.g. "10m", 0 replays anything still buffered
+	viper.SetDefault("filters.max_regex_length", 256)
+	viper.SetDefault("filters.max_path_depth", 10)
+	viper.SetDefault("filters.max_group_depth", 4)
+	viper.SetDefault("filters.max_conditions", 32)
+	viper.SetDefault("sse.max_connections", 0) // counts /events and /ws streams, 0 means unlimited
+	viper.SetDefault("sse.retry_after", 5)
+	viper.SetDefault("sse.max_header_bytes", 16384)
+	viper.SetDefault("sse.max_query_length", 8192)
+	viper.SetDefault("filter.tokenless_events", "drop")   // or "route"
+	viper.SetDefault("filter.always_deliver", []string{}) // event names that skip sampling and rate limits, e.g. ["$exception"]
+	viper.SetDefault("sse.reconnect_after", 0)            // e.g. "30m", 0 disables the header
+	viper.SetDefault("sse.idle_timeout", 0)               // e.g. "5m", 0 keeps quiet streams open
+	viper.SetDefault("sse.coalesce_window", "500ms")
+	viper.SetDefault("sse.heartbeat_interval", 0) // e.g. "15s", 0 disables heartbeats
+	viper.SetDefault("sse.order_window", "1s")
+	viper.SetDefault("sse.ack_buffer_size", 1000)
+	viper.SetDefault("sse.ack_retention", "1m")
+	viper.SetDefault("sse.flush_interval", 0) // e.g. "10ms", 0 flushes after every event
+	viper.SetDefault("sse.flush_max_events", 0)
+	viper.SetDefault("sse.pause_buffer_size", 1000)
+	viper.SetDefault("websocket.allowed_origins", []string{}) // e.g. ["https://app.example.com"], same-origin pages can always connect
+	viper.SetDefault("admin.max_members", 1000)
+	viper.SetDefault("admin.hash_members", false)
+	viper.SetDefault("sse.auth_failure", "status") // or "event"
+	viper.SetDefault("redis.pubsub.enabled", false)
+	viper.SetDefault("redis.pubsub.queue_size", 10000)
+	viper.SetDefault("startup.delay_min", 0)
+	viper.SetDefault("startup.delay_max", 0) // e.g. "30s", 0 accepts streams as soon as the server is up
+	viper.SetDefault("shutdown.timeout", "30s")
+	viper.SetDefault("shutdown.drain_window", "10s")
+	viper.SetDefault("shutdown.retry_min", "1s")
+	viper.SetDefault("shutdown.retry_max", "10s")
+	viper.SetDefault("cloudevents.source", "posthog/livestream")
+	viper.SetDefault("instance.include_in_events", false)
 }
@@ -5,11 +5,10 @@ import (
 
 	"github.com/getsentry/sentry-go"
 	"github.com/jackc/pgx/v5"
-	"github.com/spf13/viper"
 )
 
 func getPGConn() (*pgx.Conn, error) {
-	url := viper.GetString("postgres.url")
+	url := conf.Postgres.URL
 	conn, err := pgx.Connect(context.Background(), url)
 	if err != nil {
 		sentry.CaptureException(err)
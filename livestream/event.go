@@ -22,8 +22,12 @@ func (ev *Event) WriteTo(w http.ResponseWriter) error {
 	}
 
 	if len(ev.Data) > 0 {
-		if _, err := fmt.Fprintf(w, "id: %s\n", ev.ID); err != nil {
-			return err
+		// An empty id would reset the client's Last-Event-ID, so frames
+		// without one (summaries, heartbeats) leave it out.
+		if len(ev.ID) > 0 {
+			if _, err := fmt.Fprintf(w, "id: %s\n", ev.ID); err != nil {
+				return err
+			}
 		}
 
 		sd := bytes.Split(ev.Data, []byte("\n"))
@@ -2,28 +2,73 @@ package main
 
 import (
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math"
+	"math/rand"
 	"sync/atomic"
+	"time"
 
 	"github.com/gofrs/uuid/v5"
 	"golang.org/x/exp/slices"
+	"golang.org/x/time/rate"
 )
 
 type Subscription struct {
-	// Client
+	// ClientId identifies the subscription to the filter and to side requests
+	// such as acks. It is always generated by newSubscriptionID, never taken
+	// from the client, so one client can't name another's subscription.
 	ClientId string
 
 	// Filters
-	TeamId     int
-	Token      string
-	DistinctId string
-	EventTypes []string
+	TeamId      int
+	Token       string
+	DistinctId  string
+	DistinctIDs []string
+	EventTypes  []string
+	Properties  []PropertyFilter
 
 	Geo bool
 
+	// UserSampleRate, between 0 and 1, limits the subscription to a stable
+	// fraction of users: an event is only included if its distinct ID hashes
+	// into the sample. 0 or 1 includes everyone.
+	UserSampleRate float64
+
+	// ActiveHours, when set, drops events that arrive outside the window.
+	ActiveHours *ActiveHours
+
+	// MaxEventsPerSecond caps delivery to this subscription; events over the
+	// limit are dropped and counted in Dropped. 0 means no limit.
+	MaxEventsPerSecond float64
+	limiter            *rate.Limiter
+
+	// Replay
+	Replay      ReplayMode
+	LastEventID string
+
 	// Channels
 	EventChan   chan interface{}
 	ShouldClose *atomic.Bool
+
+	// Dropped counts events that matched but were never delivered: those
+	// that found EventChan full, those over MaxEventsPerSecond and those
+	// that didn't fit in the pause buffer while the stream was paused.
+	Dropped *atomic.Int64
+
+	// Revoked is closed when the filter drops the subscription because its
+	// token was revoked; the transport should tell the client and hang up.
+	Revoked chan struct{}
+
+	// Reconnect receives a delay when the token's subscribers are being moved
+	// to other nodes; after it, the transport should ask the client to
+	// reconnect and hang up. It needs a buffer of one.
+	Reconnect chan time.Duration
+
+	// DisconnectOnOverflow makes a full EventChan end the subscription rather
+	// than drop the event: the filter removes it and closes Overflowed.
+	DisconnectOnOverflow bool
+	Overflowed           chan struct{}
 }
 
 type ResponsePostHogEvent struct {
@@ -33,6 +78,26 @@ type ResponsePostHogEvent struct {
 	PersonId   string                 `json:"person_id"`
 	Event      string                 `json:"event"`
 	Properties map[string]interface{} `json:"properties"`
+
+	// Count is the number of events folded into this one when the
+	// subscription coalesces repeated events.
+	Count int `json:"count,omitempty"`
+
+	// Instance is the node that ingested the event, with
+	// instance.include_in_events enabled.
+	Instance string `json:"instance,omitempty"`
+
+	// ID is the event's sequence ID with replay.sequence_ids enabled.
+	ID string `json:"-"`
+}
+
+// eventID is the ID the event is sent with, which clients pass back as
+// Last-Event-ID or to ack it: its sequence ID if it has one, else its UUID.
+func (e ResponsePostHogEvent) eventID() string {
+	if e.ID != "" {
+		return e.ID
+	}
+	return e.Uuid
 }
 
 type ResponseGeoEvent struct {
@@ -41,15 +106,151 @@ type ResponseGeoEvent struct {
 	Count uint    `json:"count"`
 }
 
+// SubscriptionObserver is notified when subscriptions are added to or removed
+// from the filter, once each per subscription. Callbacks are queued in order
+// and run one at a time on their own goroutine, so a slow observer never holds
+// up the fan-out: once it falls observerQueueSize callbacks behind, further
+// callbacks are dropped and counted in ObserverCallbacksDropped.
+type SubscriptionObserver interface {
+	OnSubscribe(sub Subscription)
+	OnUnsubscribe(sub Subscription)
+}
+
+const observerQueueSize = 1024
+
+type noopSubscriptionObserver struct{}
+
+func (noopSubscriptionObserver) OnSubscribe(Subscription)   {}
+func (noopSubscriptionObserver) OnUnsubscribe(Subscription) {}
+
 type Filter struct {
 	inboundChan chan PostHogEvent
 	subChan     chan Subscription
 	unSubChan   chan Subscription
+	updateChan  chan Subscription
+	revokeChan  chan string
+	reconnects  chan reconnectRequest
 	subs        []Subscription
+	observer    SubscriptionObserver
+	notify      chan func()
+	done        chan struct{}
+
+	replaySize   int
+	replayMaxAge time.Duration
+	replay       *replayBuffers
+	sequenceIDs  bool
+	sequences    sequences
+
+	routeTokenless bool
+
+	alwaysDeliver map[string]bool
+
+	includeInstance bool
+
+	transforms []EventTransform
 }
 
 func NewFilter(subChan chan Subscription, unSubChan chan Subscription, inboundChan chan PostHogEvent) *Filter {
-	return &Filter{subChan: subChan, unSubChan: unSubChan, inboundChan: inboundChan, subs: make([]Subscription, 0)}
+	replay := newReplayBuffers(conf.Replay.BufferSize, conf.Replay.MaxTokens,
+		conf.Replay.MaxBytes, conf.Replay.IdleTTL)
+
+	return &Filter{
+		subChan:      subChan,
+		unSubChan:    unSubChan,
+		updateChan:   make(chan Subscription),
+		revokeChan:   make(chan string),
+		reconnects:   make(chan reconnectRequest),
+		inboundChan:  inboundChan,
+		subs:         make([]Subscription, 0),
+		observer:     noopSubscriptionObserver{},
+		notify:       make(chan func(), observerQueueSize),
+		done:         make(chan struct{}),
+		replaySize:   conf.Replay.BufferSize,
+		replayMaxAge: conf.Replay.MaxAge,
+		replay:       replay,
+		sequenceIDs:  conf.Replay.SequenceIDs,
+		sequences:    make(sequences),
+
+		routeTokenless: conf.Filter.TokenlessEvents == "route",
+
+		alwaysDeliver: alwaysDeliverFromConfig(),
+
+		includeInstance: conf.Instance.IncludeInEvents,
+
+		transforms: transformsFromConfig(),
+	}
+}
+
+// alwaysDeliverFromConfig returns the event names on filter.always_deliver.
+func alwaysDeliverFromConfig() map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range conf.Filter.AlwaysDeliver {
+		names[name] = true
+	}
+	return names
+}
+
+// Subscribe registers sub with the filter. It returns false if the filter has
+// been stopped.
+func (c *Filter) Subscribe(sub Subscription) bool {
+	select {
+	case c.subChan <- sub:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// Unsubscribe removes sub from the filter. It doesn't block once the filter
+// has been stopped.
+func (c *Filter) Unsubscribe(sub Subscription) {
+	select {
+	case c.unSubChan <- sub:
+	case <-c.done:
+	}
+}
+
+// Update swaps in sub for the subscription it was copied from, the one
+// sharing its EventChan, so a client can change its filters in place but
+// never touch another subscription. Unlike unsubscribing and subscribing
+// again, no events are missed or replayed and the observer isn't notified. It
+// returns false if the filter has been stopped.
+func (c *Filter) Update(sub Subscription) bool {
+	select {
+	case c.updateChan <- sub:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// UnsubscribeToken removes every subscription for token, closing each one's
+// Revoked channel. It doesn't block once the filter has been stopped.
+func (c *Filter) UnsubscribeToken(token string) {
+	select {
+	case c.revokeChan <- token:
+	case <-c.done:
+	}
+}
+
+// Stop ends fan-out; Run returns shortly after.
+func (c *Filter) Stop() {
+	close(c.done)
+}
+
+// AddTransform appends a transform to run on every event sent to subscribers,
+// after the ones configured in transforms.*. It must be called before Run.
+func (c *Filter) AddTransform(transform EventTransform) {
+	c.transforms = append(c.transforms, transform)
+}
+
+// SetObserver registers an observer for subscription lifecycle events. It must
+// be called before Run. Passing nil restores the default no-op observer.
+func (c *Filter) SetObserver(observer SubscriptionObserver) {
+	if observer == nil {
+		observer = noopSubscriptionObserver{}
+	}
+	c.observer = observer
 }
 
 func convertToResponseGeoEvent(event PostHogEvent) *ResponseGeoEvent {
@@ -68,6 +269,8 @@ func convertToResponsePostHogEvent(event PostHogEvent, teamId int) *ResponsePost
 		PersonId:   uuidFromDistinctId(teamId, event.DistinctId),
 		Event:      event.Event,
 		Properties: event.Properties,
+		Instance:   event.Instance,
+		ID:         event.sequenceID(),
 	}
 }
 
@@ -87,26 +290,322 @@ func uuidFromDistinctId(teamId int, distinctId string) string {
 	return uuid.NewV5(*personUUIDV5Namespace, input).String()
 }
 
-func removeSubscription(clientId string, subs []Subscription) []Subscription {
-	var lighterSubs []Subscription
+// newSubscriptionID returns a fresh ClientId.
+func newSubscriptionID() string {
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+// removeSubscription removes the subscription for clientId from subs. removed
+// is false if there was none, such as when the filter has already dropped it.
+func removeSubscription(clientId string, subs []Subscription) (remaining []Subscription, removed bool) {
 	for i, sub := range subs {
 		if clientId == sub.ClientId {
-			lighterSubs = slices.Delete(subs, i, i+1)
+			return slices.Delete(subs, i, i+1), true
+		}
+	}
+	return subs, false
+}
+
+type reconnectRequest struct {
+	token  string
+	window time.Duration
+	sent   chan int
+}
+
+// ReconnectToken asks every subscriber of token to reconnect, each after a
+// random delay within window so they don't all land on the other nodes at
+// once. Until then they keep receiving events. It returns how many
+// subscribers were asked.
+func (c *Filter) ReconnectToken(token string, window time.Duration) int {
+	req := reconnectRequest{token: token, window: window, sent: make(chan int, 1)}
+	select {
+	case c.reconnects <- req:
+		return <-req.sent
+	case <-c.done:
+		return 0
+	}
+}
+
+func (c *Filter) reconnectToken(req reconnectRequest) {
+	sent := 0
+	for _, sub := range c.subs {
+		if sub.Token != req.token || sub.Reconnect == nil {
+			continue
+		}
+		var delay time.Duration
+		if req.window > 0 {
+			delay = time.Duration(rand.Int63n(int64(req.window)))
+		}
+		select {
+		case sub.Reconnect <- delay:
+			sent++
+		default:
+			// Already asked to reconnect.
 		}
 	}
-	return lighterSubs
+	req.sent <- sent
+}
+
+// revokeToken closes the Revoked channel of every subscription for token and
+// returns the remaining subscriptions.
+func (c *Filter) revokeToken(token string) []Subscription {
+	kept := c.subs[:0]
+	for _, sub := range c.subs {
+		if sub.Token != token {
+			kept = append(kept, sub)
+			continue
+		}
+		if sub.Revoked != nil {
+			close(sub.Revoked)
+		}
+		c.notifyUnsubscribe(sub)
+	}
+	return kept
+}
+
+func (c *Filter) notifyUnsubscribe(sub Subscription) {
+	c.queueCallback(func() { c.observer.OnUnsubscribe(sub) })
+}
+
+// queueCallback hands callback to the observer goroutine without blocking.
+func (c *Filter) queueCallback(callback func()) {
+	select {
+	case c.notify <- callback:
+	default:
+		ObserverCallbacksDropped.Inc()
+	}
+}
+
+// overflow handles an event that didn't fit in sub's EventChan. It is counted
+// as dropped and, for subscriptions that would rather be disconnected, sub is
+// added to overflowed for removal once the fan-out is done.
+func (c *Filter) overflow(sub Subscription, overflowed []Subscription) []Subscription {
+	sub.Dropped.Add(1)
+	if !sub.DisconnectOnOverflow || sub.Overflowed == nil {
+		return overflowed
+	}
+	close(sub.Overflowed)
+	return append(overflowed, sub)
+}
+
+// matches reports whether event is one sub asked for. Checks run cheapest
+// first and stop at the first that fails: the token and distinct ID, then the
+// event name, then sampling and active hours, and property filters last, which
+// parsePropertyFilters has already put in order of cost. With alwaysDeliver,
+// for events on filter.always_deliver, the subscription's sampling is skipped.
+func (sub Subscription) matches(event PostHogEvent, alwaysDeliver bool) bool {
+	if sub.Token != "" && event.Token != sub.Token {
+		return false
+	}
+
+	if sub.DistinctId != "" && event.DistinctId != sub.DistinctId {
+		return false
+	}
+
+	if len(sub.DistinctIDs) > 0 && !slices.Contains(sub.DistinctIDs, event.DistinctId) {
+		return false
+	}
+
+	if len(sub.EventTypes) > 0 && !slices.Contains(sub.EventTypes, event.Event) {
+		return false
+	}
+
+	if !alwaysDeliver && sub.UserSampleRate > 0 && sub.UserSampleRate < 1 && !inUserSample(event.DistinctId, sub.UserSampleRate) {
+		return false
+	}
+
+	if sub.ActiveHours != nil && !sub.ActiveHours.contains(time.Now()) {
+		return false
+	}
+
+	for _, property := range sub.Properties {
+		if !property.matches(event.Properties) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// observeBufferUtilization records how close sub is to filling its buffer,
+// to show how much headroom subscribers have before events start to drop.
+func observeBufferUtilization(sub Subscription) {
+	if size := cap(sub.EventChan); size > 0 {
+		SubscriberBufferUtilization.Observe(float64(len(sub.EventChan)) / float64(size))
+	}
+}
+
+// inUserSample reports whether distinctId falls in a sample of the given
+// rate. The hash doesn't change between events or connections, so a user is
+// either always in the sample or never.
+func inUserSample(distinctId string, rate float64) bool {
+	h := fnv.New64a()
+	h.Write([]byte(distinctId))
+
+	// FNV's high bits barely change between similar IDs ("user1", "user2"),
+	// so mix them before comparing against the rate.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return float64(x) < rate*math.MaxUint64
+}
+
+// withRateLimit sets MaxEventsPerSecond and the token bucket enforcing it. The
+// bucket holds a second's worth of events, so short bursts within the rate
+// still get through.
+func (sub Subscription) withRateLimit(maxEventsPerSecond float64) Subscription {
+	sub.MaxEventsPerSecond = maxEventsPerSecond
+	sub.limiter = nil
+	if maxEventsPerSecond > 0 {
+		sub.limiter = rate.NewLimiter(rate.Limit(maxEventsPerSecond), int(math.Max(1, math.Ceil(maxEventsPerSecond))))
+	}
+	return sub
+}
+
+// replayTo sends the buffered events a new subscription asked for. Like the
+// live fan-out it never blocks, so a replay larger than the subscriber's
+// channel is truncated.
+func (c *Filter) replayTo(sub Subscription) {
+	if sub.Replay == ReplayNone || sub.Geo || sub.Token == "" {
+		return
+	}
+
+	if sub.Replay == ReplayLastEventID && sub.LastEventID == "" {
+		return
+	}
+
+	// Backfill never reaches further back than replay.max_age.
+	var notBefore time.Time
+	if c.replayMaxAge > 0 {
+		notBefore = time.Now().Add(-c.replayMaxAge)
+	}
+
+	buffer, ok := c.replay.get(sub.Token, time.Now())
+	if !ok {
+		if sub.Replay == ReplayLastEventID {
+			c.sendGap(sub)
+		}
+		return
+	}
+
+	var events []PostHogEvent
+	if sub.Replay == ReplayLastEventID {
+		var complete bool
+		events, complete = buffer.since(sub.LastEventID, notBefore)
+		if !complete {
+			c.sendGap(sub)
+		}
+	} else {
+		events = buffer.all(notBefore)
+	}
+
+	for _, event := range events {
+		if !sub.matches(event, c.alwaysDeliver[event.Event]) {
+			continue
+		}
+
+		select {
+		case sub.EventChan <- *convertToResponsePostHogEvent(c.transform(event), sub.TeamId):
+		default:
+			return
+		}
+	}
+}
+
+func (c *Filter) sendGap(sub Subscription) {
+	select {
+	case sub.EventChan <- ReplayGap{LastEventID: sub.LastEventID}:
+	default:
+	}
+}
+
+// transform runs the filter's transforms on an event that is about to be sent.
+// Subscriptions are matched against the event as it was ingested, so a filter
+// on a redacted property still works, and events nobody asked for aren't
+// transformed at all.
+func (c *Filter) transform(event PostHogEvent) PostHogEvent {
+	for _, transform := range c.transforms {
+		event = transform(event)
+	}
+	return event
+}
+
+func (c *Filter) record(event PostHogEvent) {
+	if c.replaySize <= 0 || event.Token == "" {
+		return
+	}
+
+	c.replay.add(event, time.Now())
 }
 
 func (c *Filter) Run() {
+	go func() {
+		for callback := range c.notify {
+			callback()
+		}
+	}()
+	defer close(c.notify)
+
 	for {
 		select {
+		case <-c.done:
+			return
 		case newSub := <-c.subChan:
 			c.subs = append(c.subs, newSub)
+			c.replayTo(newSub)
+			c.queueCallback(func() { c.observer.OnSubscribe(newSub) })
 		case unSub := <-c.unSubChan:
-			c.subs = removeSubscription(unSub.ClientId, c.subs)
+			// A revoked subscription was already removed, and its observer
+			// notified, by revokeToken; the transport unsubscribing when it
+			// hangs up must not notify it again.
+			var removed bool
+			if c.subs, removed = removeSubscription(unSub.ClientId, c.subs); removed {
+				c.notifyUnsubscribe(unSub)
+			}
+		case updated := <-c.updateChan:
+			for i := range c.subs {
+				if c.subs[i].EventChan == updated.EventChan {
+					c.subs[i] = updated
+					break
+				}
+			}
+		case token := <-c.revokeChan:
+			c.subs = c.revokeToken(token)
+		case req := <-c.reconnects:
+			c.reconnectToken(req)
 		case event := <-c.inboundChan:
+			// Events without a token can't be attributed to a project. By
+			// default they are dropped; with filter.tokenless_events=route they
+			// only reach wildcard subscriptions that aren't scoped to a token.
+			if event.Token == "" && !c.routeTokenless {
+				EventsDropped.WithLabelValues("no_token").Inc()
+				continue
+			}
+
+			// Events ingested here rather than received over pub/sub come
+			// from this node.
+			if !c.includeInstance {
+				event.Instance = ""
+			} else if event.Instance == "" {
+				event.Instance = InstanceID()
+			}
+
+			if c.sequenceIDs && event.Token != "" {
+				event.Seq = c.sequences.next(event.Token)
+			}
+
+			// Critical events, such as $exception, reach every subscriber
+			// that asked for them regardless of sampling or rate limits.
+			alwaysDeliver := c.alwaysDeliver[event.Event]
+
 			var responseEvent *ResponsePostHogEvent
 			var responseGeoEvent *ResponseGeoEvent
+			var overflowed []Subscription
+
+			c.record(event)
 
 			for _, sub := range c.subs {
 				if sub.ShouldClose.Load() {
@@ -115,43 +614,53 @@ func (c *Filter) Run() {
 				}
 
 				// log.Printf("event.Token: %s, sub.Token: %s", event.Token, sub.Token)
-				if sub.Token != "" && event.Token != sub.Token {
+				if !sub.matches(event, alwaysDeliver) {
 					continue
 				}
 
-				if sub.DistinctId != "" && event.DistinctId != sub.DistinctId {
-					continue
-				}
-
-				if len(sub.EventTypes) > 0 && !slices.Contains(sub.EventTypes, event.Event) {
+				if sub.limiter != nil && !alwaysDeliver && !sub.limiter.Allow() {
+					sub.Dropped.Add(1)
 					continue
 				}
 
 				if sub.Geo {
 					if event.Lat != 0.0 {
 						if responseGeoEvent == nil {
-							responseGeoEvent = convertToResponseGeoEvent(event)
+							responseGeoEvent = convertToResponseGeoEvent(c.transform(event))
 						}
 
 						select {
 						case sub.EventChan <- *responseGeoEvent:
+							observeBufferUtilization(sub)
 						default:
 							// Don't block
+							overflowed = c.overflow(sub, overflowed)
 						}
 					}
 				} else {
 					if responseEvent == nil {
-						responseEvent = convertToResponsePostHogEvent(event, sub.TeamId)
+						responseEvent = convertToResponsePostHogEvent(c.transform(event), sub.TeamId)
 					}
 
 					select {
 					case sub.EventChan <- *responseEvent:
+						observeBufferUtilization(sub)
 					default:
 						// Don't block
+						overflowed = c.overflow(sub, overflowed)
 					}
 				}
 			}
 
+			// The observer hears about an overflowed subscription here, where
+			// it is removed, and not again when the transport unsubscribes.
+			for _, sub := range overflowed {
+				var removed bool
+				if c.subs, removed = removeSubscription(sub.ClientId, c.subs); removed {
+					c.notifyUnsubscribe(sub)
+				}
+			}
+
 		}
 	}
 }
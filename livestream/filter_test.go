@@ -0,0 +1,526 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// recordingObserver records subscription callbacks as "+id" and "-id".
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) OnSubscribe(sub Subscription) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, "+"+sub.ClientId)
+}
+
+func (o *recordingObserver) OnUnsubscribe(sub Subscription) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, "-"+sub.ClientId)
+}
+
+// waitFor returns the recorded callbacks once there are n of them, failing
+// the test if that takes too long.
+func (o *recordingObserver) waitFor(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		o.mu.Lock()
+		events := append([]string(nil), o.events...)
+		o.mu.Unlock()
+		if len(events) >= n || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newTestFilter(t *testing.T) (*Filter, *recordingObserver) {
+	t.Helper()
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent))
+	observer := &recordingObserver{}
+	filter.SetObserver(observer)
+	go filter.Run()
+	t.Cleanup(filter.Stop)
+	return filter, observer
+}
+
+func newTestSubscription(clientId, token string) Subscription {
+	return Subscription{
+		ClientId:    clientId,
+		Token:       token,
+		EventChan:   make(chan interface{}, 10),
+		ShouldClose: &atomic.Bool{},
+		Dropped:     &atomic.Int64{},
+		Revoked:     make(chan struct{}),
+		Reconnect:   make(chan time.Duration, 1),
+		Overflowed:  make(chan struct{}),
+	}
+}
+
+func TestObserverCallbacksAreOrdered(t *testing.T) {
+	filter, observer := newTestFilter(t)
+
+	var want []string
+	for _, id := range []string{"a", "b", "c"} {
+		sub := newTestSubscription(id, "token")
+		filter.Subscribe(sub)
+		filter.Unsubscribe(sub)
+		want = append(want, "+"+id, "-"+id)
+	}
+
+	got := observer.waitFor(t, len(want))
+	if !slices.Equal(got, want) {
+		t.Fatalf("got callbacks %v, want %v", got, want)
+	}
+}
+
+func TestRevokedSubscriptionIsUnsubscribedOnce(t *testing.T) {
+	filter, observer := newTestFilter(t)
+
+	revoked := newTestSubscription("a", "revoked")
+	kept := newTestSubscription("b", "kept")
+	filter.Subscribe(revoked)
+	filter.Subscribe(kept)
+	filter.UnsubscribeToken("revoked")
+
+	select {
+	case <-revoked.Revoked:
+	case <-time.After(time.Second):
+		t.Fatal("revoked subscription's Revoked channel wasn't closed")
+	}
+	// The transport unsubscribes as it hangs up.
+	filter.Unsubscribe(revoked)
+	filter.Unsubscribe(kept)
+
+	want := []string{"+a", "+b", "-a", "-b"}
+	got := observer.waitFor(t, len(want)+1)
+	if !slices.Equal(got, want) {
+		t.Fatalf("got callbacks %v, want %v", got, want)
+	}
+}
+
+func TestOverflowedSubscriptionIsUnsubscribedOnce(t *testing.T) {
+	filter, observer := newTestFilter(t)
+
+	sub := newTestSubscription("a", "token")
+	sub.EventChan = make(chan interface{}, 1)
+	sub.DisconnectOnOverflow = true
+	filter.Subscribe(sub)
+	for i := 0; i < 2; i++ {
+		filter.inboundChan <- PostHogEvent{Token: "token", Event: "$pageview"}
+	}
+
+	select {
+	case <-sub.Overflowed:
+	case <-time.After(time.Second):
+		t.Fatal("overflowed subscription's Overflowed channel wasn't closed")
+	}
+	// The transport unsubscribes as it hangs up.
+	filter.Unsubscribe(sub)
+
+	want := []string{"+a", "-a"}
+	got := observer.waitFor(t, len(want)+1)
+	if !slices.Equal(got, want) {
+		t.Fatalf("got callbacks %v, want %v", got, want)
+	}
+	if dropped := sub.Dropped.Load(); dropped != 1 {
+		t.Errorf("got %d dropped events, want 1", dropped)
+	}
+}
+
+// stalledObserver blocks every callback until release is closed.
+type stalledObserver struct {
+	release chan struct{}
+}
+
+func (o stalledObserver) OnSubscribe(Subscription)   { <-o.release }
+func (o stalledObserver) OnUnsubscribe(Subscription) { <-o.release }
+
+func TestStalledObserverDoesNotBlockDelivery(t *testing.T) {
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent))
+	observer := stalledObserver{release: make(chan struct{})}
+	filter.SetObserver(observer)
+	go filter.Run()
+	t.Cleanup(filter.Stop)
+	t.Cleanup(func() { close(observer.release) })
+
+	dropped := testutil.ToFloat64(ObserverCallbacksDropped)
+	// Enough churn to fill the observer's queue several times over.
+	for i := 0; i < 2*observerQueueSize; i++ {
+		sub := newTestSubscription(strconv.Itoa(i), "churn")
+		filter.Subscribe(sub)
+		filter.Unsubscribe(sub)
+	}
+
+	sub := newTestSubscription("live", "token")
+	filter.Subscribe(sub)
+	select {
+	case filter.inboundChan <- PostHogEvent{Token: "token", Event: "$pageview"}:
+	case <-time.After(time.Second):
+		t.Fatal("the filter stopped taking events while the observer was stalled")
+	}
+	select {
+	case <-sub.EventChan:
+	case <-time.After(time.Second):
+		t.Fatal("event not delivered while the observer was stalled")
+	}
+
+	if got := testutil.ToFloat64(ObserverCallbacksDropped) - dropped; got < observerQueueSize {
+		t.Errorf("counted %v dropped callbacks, want at least %d", got, observerQueueSize)
+	}
+}
+
+func TestUpdateSwapsFiltersInPlace(t *testing.T) {
+	filter, observer := newTestFilter(t)
+
+	sub := newTestSubscription("a", "token")
+	sub.EventTypes = []string{"before"}
+	filter.Subscribe(sub)
+
+	updated := sub
+	updated.EventTypes = []string{"after"}
+	filter.Update(updated)
+	for _, name := range []string{"before", "after"} {
+		filter.inboundChan <- PostHogEvent{Token: "token", Event: name}
+	}
+
+	select {
+	case payload := <-sub.EventChan:
+		if event := payload.(ResponsePostHogEvent); event.Event != "after" {
+			t.Errorf("got %q, want only the event matching the updated filters", event.Event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event delivered after the update")
+	}
+	if len(sub.EventChan) != 0 {
+		t.Errorf("got %d more events, want none", len(sub.EventChan))
+	}
+
+	want := []string{"+a"}
+	if got := observer.waitFor(t, len(want)+1); !slices.Equal(got, want) {
+		t.Errorf("got callbacks %v, want %v", got, want)
+	}
+}
+
+func TestUpdateOnlyReplacesItself(t *testing.T) {
+	filter, _ := newTestFilter(t)
+
+	victim := newTestSubscription("a", "token")
+	filter.Subscribe(victim)
+
+	// Same ClientId, but not a copy of the victim's subscription.
+	impostor := newTestSubscription("a", "other")
+	impostor.EventTypes = []string{"nothing"}
+	filter.Update(impostor)
+	filter.inboundChan <- PostHogEvent{Token: "token", Event: "$pageview"}
+
+	select {
+	case <-victim.EventChan:
+	case <-time.After(time.Second):
+		t.Fatal("another subscription's update replaced the victim's filters")
+	}
+	if len(impostor.EventChan) != 0 {
+		t.Error("the impostor received the victim's events")
+	}
+}
+
+func TestTransformsRunAfterMatching(t *testing.T) {
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent))
+	filter.AddTransform(redactProperties(nil, []string{"email"}))
+	go filter.Run()
+	t.Cleanup(filter.Stop)
+
+	sub := newTestSubscription("a", "token")
+	sub.Properties = []PropertyFilter{{Key: "email", Operator: OperatorEndsWith, Value: "@example.com"}}
+	filter.Subscribe(sub)
+	for _, email := range []string{"a@example.net", "b@example.com"} {
+		filter.inboundChan <- PostHogEvent{
+			Token:      "token",
+			DistinctId: email,
+			Properties: map[string]interface{}{"email": email, "plan": "free"},
+		}
+	}
+
+	select {
+	case payload := <-sub.EventChan:
+		event := payload.(ResponsePostHogEvent)
+		if event.DistinctId != "b@example.com" {
+			t.Errorf("got event for %q, want only the one whose email matched", event.DistinctId)
+		}
+		if _, ok := event.Properties["email"]; ok {
+			t.Error("matched event wasn't redacted")
+		}
+		if event.Properties["plan"] != "free" {
+			t.Errorf("got properties %v, want plan kept", event.Properties)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event matching on a redacted property wasn't delivered")
+	}
+}
+
+// eventsUntil reads sub's events until one named marker arrives and returns
+// the names of those before it. The filter delivers in order, so sending a
+// marker after the events under test shows when they have all been handled.
+func eventsUntil(t *testing.T, sub Subscription, marker string) []string {
+	t.Helper()
+	var names []string
+	for {
+		select {
+		case payload := <-sub.EventChan:
+			event := payload.(ResponsePostHogEvent)
+			if event.Event == marker {
+				return names
+			}
+			names = append(names, event.Event)
+		case <-time.After(time.Second):
+			t.Fatalf("%s wasn't delivered, got %v", marker, names)
+		}
+	}
+}
+
+func TestTokenlessEvents(t *testing.T) {
+	tests := []struct {
+		policy       string
+		wantWildcard []string
+		wantDropped  float64
+	}{
+		{policy: "drop", wantDropped: 1},
+		{policy: "route", wantWildcard: []string{"tokenless"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			setConfig(t, "filter.tokenless_events", tt.policy)
+			filter, _ := newTestFilter(t)
+			wildcard := newTestSubscription("wildcard", "")
+			scoped := newTestSubscription("scoped", "token")
+			filter.Subscribe(wildcard)
+			filter.Subscribe(scoped)
+			dropped := testutil.ToFloat64(EventsDropped.WithLabelValues("no_token"))
+
+			filter.inboundChan <- PostHogEvent{Event: "tokenless"}
+			filter.inboundChan <- PostHogEvent{Token: "token", Event: "marker"}
+
+			if got := eventsUntil(t, wildcard, "marker"); !slices.Equal(got, tt.wantWildcard) {
+				t.Errorf("wildcard subscription got %v, want %v", got, tt.wantWildcard)
+			}
+			if got := eventsUntil(t, scoped, "marker"); len(got) > 0 {
+				t.Errorf("token-scoped subscription got %v, want no tokenless events", got)
+			}
+			if got := testutil.ToFloat64(EventsDropped.WithLabelValues("no_token")) - dropped; got != tt.wantDropped {
+				t.Errorf("counted %v tokenless events as dropped, want %v", got, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestMatchesDistinctIDs(t *testing.T) {
+	sub := newTestSubscription("a", "token")
+	sub.DistinctIDs = []string{"alice", "bob"}
+	sub.EventTypes = []string{"$pageview"}
+
+	tests := []struct {
+		name  string
+		event PostHogEvent
+		want  bool
+	}{
+		{name: "targeted user", event: PostHogEvent{Token: "token", DistinctId: "alice", Event: "$pageview"}, want: true},
+		{name: "another targeted user", event: PostHogEvent{Token: "token", DistinctId: "bob", Event: "$pageview"}, want: true},
+		{name: "someone else", event: PostHogEvent{Token: "token", DistinctId: "carol", Event: "$pageview"}},
+		{name: "targeted user, other event", event: PostHogEvent{Token: "token", DistinctId: "alice", Event: "$autocapture"}},
+		{name: "targeted user, other token", event: PostHogEvent{Token: "other", DistinctId: "alice", Event: "$pageview"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sub.matches(tt.event, false); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxEventsPerSecond(t *testing.T) {
+	filter, _ := newTestFilter(t)
+	limited := newTestSubscription("limited", "token").withRateLimit(10)
+	limited.EventChan = make(chan interface{}, 100)
+	// witness isn't limited, so once it has the marker the filter is done
+	// with the burst.
+	witness := newTestSubscription("witness", "token")
+	witness.EventChan = make(chan interface{}, 100)
+	filter.Subscribe(limited)
+	filter.Subscribe(witness)
+
+	burst := func(marker string) int {
+		for i := 0; i < 40; i++ {
+			filter.inboundChan <- PostHogEvent{Token: "token", Event: "$pageview"}
+		}
+		filter.inboundChan <- PostHogEvent{Token: "token", Event: marker}
+		eventsUntil(t, witness, marker)
+		delivered := 0
+		for len(limited.EventChan) > 0 {
+			<-limited.EventChan
+			delivered++
+		}
+		return delivered
+	}
+
+	// The bucket holds a second's worth of events.
+	first := burst("first")
+	if first < 10 || first > 11 {
+		t.Errorf("delivered %d of a burst of 41 events, want the 10 the bucket holds", first)
+	}
+	time.Sleep(300 * time.Millisecond)
+	second := burst("second")
+	if second < 2 || second > 5 {
+		t.Errorf("delivered %d events 300ms after the bucket ran dry, want about 3", second)
+	}
+	if got, want := limited.Dropped.Load(), int64(82-first-second); got != want {
+		t.Errorf("Dropped = %d, want the %d events over the rate", got, want)
+	}
+}
+
+func TestUserSampleRate(t *testing.T) {
+	sub := newTestSubscription("sampled", "token")
+	sub.UserSampleRate = 0.1
+	// Another connection asking for the same rate sees the same users.
+	reconnected := newTestSubscription("reconnected", "token")
+	reconnected.UserSampleRate = 0.1
+
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		distinctId := "user" + strconv.Itoa(i)
+		first := sub.matches(PostHogEvent{Token: "token", DistinctId: distinctId, Event: "$pageview"}, false)
+		for _, name := range []string{"$autocapture", "$pageleave"} {
+			event := PostHogEvent{Token: "token", DistinctId: distinctId, Event: name}
+			if sub.matches(event, false) != first || reconnected.matches(event, false) != first {
+				t.Fatalf("%s is in the sample for some of its events only", distinctId)
+			}
+		}
+		if first {
+			sampled++
+		}
+	}
+	if sampled < 70 || sampled > 130 {
+		t.Errorf("sampled %d of 1000 users, want about 100", sampled)
+	}
+}
+
+func TestInstanceInEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		instance string
+		want     string
+	}{
+		{name: "off by default", instance: "other-node"},
+		{name: "ingested here", enabled: true, want: InstanceID()},
+		{name: "received over pub/sub", enabled: true, instance: "other-node", want: "other-node"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, "instance.include_in_events", tt.enabled)
+			filter, _ := newTestFilter(t)
+			sub := newTestSubscription("client", "token")
+			filter.Subscribe(sub)
+
+			filter.inboundChan <- PostHogEvent{Token: "token", Event: "$pageview", Instance: tt.instance}
+			select {
+			case payload := <-sub.EventChan:
+				if got := payload.(ResponsePostHogEvent).Instance; got != tt.want {
+					t.Errorf("instance = %q, want %q", got, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("event wasn't delivered")
+			}
+
+			stream := openGeoStream(t, "")
+			stream.close()
+			want := ""
+			if tt.enabled {
+				want = InstanceID()
+			}
+			if got := stream.rec.Header().Get("X-Instance-ID"); got != want {
+				t.Errorf("X-Instance-ID = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSubscriberBufferUtilization(t *testing.T) {
+	utilization := func() (count uint64, sum float64) {
+		var m dto.Metric
+		if err := SubscriberBufferUtilization.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	countBefore, sumBefore := utilization()
+
+	filter, _ := newTestFilter(t)
+	sub := newTestSubscription("client", "token")
+	filter.Subscribe(sub)
+	// Nothing reads sub.EventChan, so each event fills another tenth of it.
+	for i := 0; i < 10; i++ {
+		filter.inboundChan <- PostHogEvent{Token: "token", Event: "$pageview"}
+	}
+
+	waitFor(t, "10 observations", func() bool {
+		count, _ := utilization()
+		return count-countBefore == 10
+	})
+	// 0.1 + 0.2 + ... + 1.0
+	if _, sum := utilization(); math.Abs(sum-sumBefore-5.5) > 1e-9 {
+		t.Errorf("observations sum to %v, want 5.5 as the buffer fills", sum-sumBefore)
+	}
+}
+
+func TestAlwaysDeliver(t *testing.T) {
+	setConfig(t, "filter.always_deliver", []string{"$exception"})
+	filter, _ := newTestFilter(t)
+
+	// Too small a sample for any of these users to be in it.
+	sampled := newTestSubscription("sampled", "token")
+	sampled.UserSampleRate = 0.0001
+	// The first event empties the bucket and it doesn't refill in time for
+	// the rest.
+	limited := newTestSubscription("limited", "token").withRateLimit(0.01)
+	witness := newTestSubscription("witness", "token")
+	for _, sub := range []Subscription{sampled, limited, witness} {
+		filter.Subscribe(sub)
+	}
+
+	for i, name := range []string{"$pageview", "$pageview", "$exception", "$pageview", "$exception"} {
+		filter.inboundChan <- PostHogEvent{Token: "token", DistinctId: "user" + strconv.Itoa(i), Event: name}
+	}
+	filter.inboundChan <- PostHogEvent{Token: "token", Event: "done"}
+	eventsUntil(t, witness, "done")
+
+	drain := func(sub Subscription) []string {
+		var names []string
+		for len(sub.EventChan) > 0 {
+			names = append(names, (<-sub.EventChan).(ResponsePostHogEvent).Event)
+		}
+		return names
+	}
+	if got, want := drain(sampled), []string{"$exception", "$exception"}; !slices.Equal(got, want) {
+		t.Errorf("sampled subscription got %v, want %v", got, want)
+	}
+	if got, want := drain(limited), []string{"$pageview", "$exception", "$exception"}; !slices.Equal(got, want) {
+		t.Errorf("rate limited subscription got %v, want %v", got, want)
+	}
+}
@@ -1,11 +1,849 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/getsentry/sentry-go"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/exp/slices"
 )
 
 func index(c echo.Context) error {
 	return c.String(http.StatusOK, "RealTime Hog 3000")
 }
+
+// StatsResponse is the body returned by the /stats endpoint. Optional fields
+// are only populated when requested through the include query param, e.g.
+// /stats?include=events.
+type StatsResponse struct {
+	// UsersOnProduct is the number of distinct users seen in the stats window.
+	UsersOnProduct int `json:"users_on_product,omitempty"`
+	// Events is the number of events seen in the stats window (include=events).
+	Events *int `json:"events,omitempty"`
+	// Breakdown is the number of events per event name in the stats window
+	// (include=breakdown). It has at most stats.max_event_names entries;
+	// names that don't fit are counted under "__other__".
+	Breakdown map[string]int `json:"breakdown,omitempty"`
+	// UsersPeak is the highest UsersOnProduct seen within stats.peak_window
+	// (include=peak).
+	UsersPeak *int `json:"users_peak,omitempty"`
+	// GroupUsersOnProduct is the number of distinct users across the
+	// token's stats.token_groups entry, counting users seen under several of
+	// its tokens once (include=group).
+	GroupUsersOnProduct *int `json:"group_users_on_product,omitempty"`
+	// EventsPerMinute is the event rate over the stats window, normalized to
+	// a minute whatever the window's length (include=rate).
+	EventsPerMinute *float64 `json:"events_per_minute,omitempty"`
+	// Error explains why no stats could be returned.
+	Error string `json:"error,omitempty"`
+}
+
+// includes reports whether the comma separated include query param lists field.
+func includes(c echo.Context, field string) bool {
+	return slices.Contains(strings.Split(c.QueryParam("include"), ","), field)
+}
+
+func StatsHandler(teamStats *TeamStats) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := statsToken(c)
+		if err != nil {
+			return err
+		}
+		StatsQueries.WithLabelValues(tokenBucket(token)).Inc()
+
+		return writeStats(c, teamStats.response(c, token))
+	}
+}
+
+// writeStats sends resp as JSON, or as protobuf when the request accepts it.
+// Dashboards poll the endpoint; when nothing changed they get a 304 instead
+// of the same body again.
+func writeStats(c echo.Context, resp StatsResponse) error {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	proto := strings.Contains(c.Request().Header.Get(echo.HeaderAccept), ProtobufContentType)
+
+	etag := statsETag(body, proto)
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	if proto {
+		return c.Blob(http.StatusOK, ProtobufContentType, resp.MarshalProto())
+	}
+	return c.JSONBlob(http.StatusOK, body)
+}
+
+// statsETag returns a weak ETag for a stats response. It hashes the JSON form,
+// which holds every field and encodes maps in a stable order, along with the
+// format the response is sent in.
+func statsETag(body []byte, proto bool) string {
+	h := fnv.New64a()
+	h.Write(body)
+	if proto {
+		h.Write([]byte(ProtobufContentType))
+	}
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using the
+// weak comparison that header calls for.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthHandler reports whether this node takes new streams: 200 once it
+// does, 503 during its startup delay or while draining.
+func HealthHandler(lifecycle *Lifecycle) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if _, starting := lifecycle.Starting(); starting {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "starting"})
+		}
+		if lifecycle.Draining() {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// StatsStreamHandler pushes the same stats as StatsHandler as "stats" events
+// every stats.stream_interval until the client disconnects.
+func StatsStreamHandler(teamStats *TeamStats, lifecycle *Lifecycle) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := statsToken(c)
+		if err != nil {
+			return err
+		}
+
+		w := c.Response()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		ticker := time.NewTicker(conf.Stats.StreamInterval)
+		defer ticker.Stop()
+		for {
+			jsonData, err := json.Marshal(teamStats.response(c, token))
+			if err != nil {
+				return err
+			}
+			event := Event{
+				Event: []byte("stats"),
+				Data:  jsonData,
+			}
+			if err := event.WriteTo(w); err != nil {
+				return err
+			}
+			w.Flush()
+
+			select {
+			case <-c.Request().Context().Done():
+				return nil
+			case <-lifecycle.Drain():
+				return nil
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+// statsToken authenticates a stats request and returns the project token it
+// is for.
+func statsToken(c echo.Context) (string, error) {
+	claims, err := decodeAuthFromRequest(c)
+	if err != nil {
+		return "", err
+	}
+	teamIdInt := int(claims["team_id"].(float64))
+
+	token, err := teamToken(teamIdInt)
+	if err != nil {
+		return "", err
+	}
+	if err := validateAPIToken(token); err != nil {
+		return "", echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	return token, nil
+}
+
+// response builds the stats for token, with the optional fields the request
+// asked for through include.
+func (ts *TeamStats) response(c echo.Context, token string) StatsResponse {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	hash, ok := ts.Store[token]
+	if !ok {
+		return StatsResponse{
+			Error: "no stats",
+		}
+	}
+
+	siteStats := StatsResponse{
+		UsersOnProduct: hash.Len(),
+	}
+	if includes(c, "events") {
+		events := 0
+		if counter, ok := ts.Events[token]; ok {
+			events = counter.count(time.Now())
+		}
+		siteStats.Events = &events
+	}
+	if includes(c, "group") {
+		users := ts.groupUsers(token)
+		siteStats.GroupUsersOnProduct = &users
+	}
+	if includes(c, "rate") {
+		rate := 0.0
+		if counter, ok := ts.Events[token]; ok {
+			rate = counter.perMinute(time.Now())
+		}
+		siteStats.EventsPerMinute = &rate
+	}
+	if includes(c, "breakdown") {
+		siteStats.Breakdown = ts.breakdown(token, time.Now())
+	}
+	if includes(c, "peak") {
+		peak := siteStats.UsersOnProduct
+		if recorded, ok := ts.Peaks[token]; ok && recorded.users > peak {
+			peak = recorded.users
+		}
+		siteStats.UsersPeak = &peak
+	}
+	return siteStats
+}
+
+// streamConnections counts the open /events and /ws streams, which share the
+// sse.max_connections cap.
+var streamConnections atomic.Int64
+
+// acquireConnection takes one of the sse.max_connections slots, or rejects the
+// request if they are all taken. release must be called when the stream ends.
+func acquireConnection(c echo.Context) (release func(), err error) {
+	maxConnections := conf.SSE.MaxConnections
+	if n := streamConnections.Add(1); maxConnections > 0 && n > maxConnections {
+		streamConnections.Add(-1)
+		c.Response().Header().Set("Retry-After", strconv.Itoa(conf.SSE.RetryAfter))
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, "too many connections")
+	}
+	return func() { streamConnections.Add(-1) }, nil
+}
+
+func StreamEventsHandler(filter *Filter, lifecycle *Lifecycle, acks *AckRegistry, controls *SubscriptionControls) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		received := time.Now()
+
+		if err := checkRequestSize(c.Request()); err != nil {
+			return err
+		}
+
+		// Health checkers and proxies probe with HEAD; answer with the stream's
+		// headers without subscribing.
+		if c.Request().Method == http.MethodHead {
+			setStreamHeaders(c.Response())
+			return c.NoContent(http.StatusOK)
+		}
+
+		if remaining, starting := lifecycle.Starting(); starting {
+			setRetryAfter(c, remaining)
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "starting")
+		}
+
+		if err := checkAuthBackoff(c); err != nil {
+			return err
+		}
+
+		exited, ok := lifecycle.Track()
+		if !ok {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(conf.SSE.RetryAfter))
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "shutting down")
+		}
+		defer exited()
+
+		release, err := acquireConnection(c)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		subscription, err := subscriptionFromRequest(c)
+		if err != nil {
+			c.Logger().Printf("SSE client rejected, ip: %v, error: %v", c.RealIP(), err)
+			var authErr *authError
+			if errors.As(err, &authErr) {
+				recordAuthResult(c, true)
+				return streamAuthError(c, authErr.err)
+			}
+			return err
+		}
+		// Geo streams don't authenticate, so they say nothing about whether
+		// this IP's tokens work and mustn't clear its backoff.
+		if !subscription.Geo {
+			recordAuthResult(c, false)
+		}
+
+		if accessLogs.sample() {
+			c.Logger().Printf("SSE client connected, ip: %v", c.RealIP())
+		}
+
+		if !filter.Subscribe(subscription) {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "shutting down")
+		}
+		defer func() {
+			filter.Unsubscribe(subscription)
+			subscription.ShouldClose.Store(true)
+		}()
+
+		w := c.Response()
+		setStreamHeaders(w)
+		w.Header().Set(HeaderSubscriptionID, subscription.ClientId)
+		if conf.Instance.IncludeInEvents {
+			w.Header().Set("X-Instance-ID", InstanceID())
+		}
+		// Tells clients and load balancers when this node would like them to
+		// reconnect, so connections can be rebalanced across nodes.
+		if reconnectAfter := conf.SSE.ReconnectAfter; reconnectAfter > 0 {
+			w.Header().Set("X-Reconnect-After", strconv.Itoa(int(reconnectAfter.Seconds())))
+		}
+
+		// Opt-in: close streams that haven't had anything written to them for
+		// sse.idle_timeout, e.g. clients that connect and are never sent data.
+		var idleTimer *time.Timer
+		var idle <-chan time.Time
+		idleTimeout := conf.SSE.IdleTimeout
+		if idleTimeout > 0 {
+			idleTimer = time.NewTimer(idleTimeout)
+			defer idleTimer.Stop()
+			idle = idleTimer.C
+		}
+
+		var coalesced <-chan time.Time
+		var co *coalescer
+		if coalesce := c.QueryParam("coalesce"); strings.ToLower(coalesce) == "true" || coalesce == "1" {
+			co = newCoalescer(conf.SSE.CoalesceWindow)
+			defer co.stop()
+			coalesced = co.timer.C
+		}
+
+		cloudEvents := c.QueryParam("format") == "cloudevents"
+
+		var unacked *ackBuffer
+		var redeliver []interface{}
+		if ack := c.QueryParam("ack"); strings.ToLower(ack) == "true" || ack == "1" {
+			unacked, redeliver = acks.open(subscription.ClientId, subscription.Token, c.QueryParam("resume"))
+			defer acks.close(subscription.ClientId)
+		}
+
+		// Optional micro-batching: rather than flushing after every event,
+		// flush once sse.flush_max_events are pending or sse.flush_interval
+		// has passed since the first unflushed one.
+		flushInterval := conf.SSE.FlushInterval
+		flushMaxEvents := conf.SSE.FlushMaxEvents
+		flushTimer := time.NewTimer(flushInterval)
+		flushTimer.Stop()
+		defer flushTimer.Stop()
+		unflushed := 0
+		flush := func() {
+			w.Flush()
+			unflushed = 0
+		}
+
+		var delivered int64
+		send := func(payload interface{}) error {
+			if gap, ok := payload.(ReplayGap); ok {
+				return writeGap(w, gap)
+			}
+
+			data := payload
+			if phEvent, ok := payload.(ResponsePostHogEvent); ok && cloudEvents {
+				data = toCloudEvent(phEvent)
+			}
+
+			jsonData, err := json.Marshal(data)
+			if err != nil {
+				sentry.CaptureException(err)
+				log.Println("Error marshalling payload", err)
+				return nil
+			}
+
+			event := Event{
+				Data: jsonData,
+			}
+			if phEvent, ok := payload.(ResponsePostHogEvent); ok {
+				event.ID = []byte(phEvent.eventID())
+			}
+			if err := event.WriteTo(w); err != nil {
+				return err
+			}
+			if flushInterval <= 0 {
+				w.Flush()
+			} else if unflushed++; flushMaxEvents > 0 && unflushed >= flushMaxEvents {
+				flushTimer.Stop()
+				flush()
+			} else if unflushed == 1 {
+				flushTimer.Reset(flushInterval)
+			}
+			delivered++
+			if unacked != nil && len(event.ID) > 0 {
+				unacked.add(string(event.ID), payload)
+			}
+			if idleTimer != nil {
+				idleTimer.Reset(idleTimeout)
+			}
+			return nil
+		}
+
+		// deliver hands an event to the coalescer if the subscription uses one,
+		// otherwise writes it straight away.
+		deliver := func(payload interface{}) error {
+			if phEvent, ok := payload.(ResponsePostHogEvent); ok && co != nil {
+				if flushed := co.add(phEvent); flushed != nil {
+					return send(*flushed)
+				}
+				return nil
+			}
+			return send(payload)
+		}
+
+		var ordered <-chan time.Time
+		var ord *orderer
+		if order := c.QueryParam("order"); strings.ToLower(order) == "true" || order == "1" {
+			ord = newOrderer(conf.SSE.OrderWindow)
+			defer ord.stop()
+			ordered = ord.timer.C
+		}
+
+		// receive takes an event from the filter through ordering (if
+		// enabled) and on to delivery.
+		receive := func(payload interface{}) error {
+			if phEvent, ok := payload.(ResponsePostHogEvent); ok && ord != nil {
+				if !ord.add(phEvent, time.Now()) {
+					EventsLate.Inc()
+				}
+				return nil
+			}
+			return deliver(payload)
+		}
+
+		// Clients can pause the stream, e.g. while their tab is in the
+		// background, with POST /events/:id/pause and /resume.
+		paused := newPauseBuffer(subscription.Dropped)
+		signals := controls.register(subscription.ClientId, subscription.Token)
+		defer controls.unregister(subscription.ClientId)
+
+		for _, payload := range redeliver {
+			if err := send(payload); err != nil {
+				return err
+			}
+		}
+
+		SubscriptionSetupDuration.Observe(time.Since(received).Seconds())
+
+		drain := lifecycle.Drain()
+		var drainClose <-chan time.Time
+		closeEvent := "summary"
+
+		// Heartbeats keep proxies and clients from timing out quiet streams.
+		// They are comments by default; heartbeat=event sends them as
+		// "heartbeat" events for parsers that ignore comments.
+		var heartbeat <-chan time.Time
+		if interval := conf.SSE.HeartbeatInterval; interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			heartbeat = ticker.C
+		}
+		heartbeatEvents := c.QueryParam("heartbeat") == "event"
+
+		for {
+			select {
+			case <-c.Request().Context().Done():
+				if accessLogs.disconnect(subscription) {
+					c.Logger().Printf("SSE client disconnected, ip: %v, dropped: %d", c.RealIP(), subscription.Dropped.Load())
+				}
+				return nil
+			case <-drain:
+				// Stop watching Drain and close after a random delay instead.
+				drain = nil
+				drainClose = time.After(lifecycle.DrainDelay())
+			case delay := <-subscription.Reconnect:
+				// Moved to another node: same as draining, but only for this
+				// token, so the client is told to reconnect.
+				drain = nil
+				drainClose = time.After(delay)
+				closeEvent = "reconnect"
+			case <-subscription.Overflowed:
+				c.Logger().Printf("SSE client fell behind, closing, ip: %v", c.RealIP())
+				return writeSummaryEvent(w, "overflow", delivered, subscription, "")
+			case <-subscription.Revoked:
+				c.Logger().Printf("Token revoked, closing SSE client, ip: %v", c.RealIP())
+				event := Event{Event: []byte("revoked"), Data: []byte("{}")}
+				if err := event.WriteTo(w); err != nil {
+					return err
+				}
+				w.Flush()
+				return nil
+			case <-drainClose:
+				c.Logger().Printf("Draining, closing SSE client, ip: %v", c.RealIP())
+				return writeSummaryEvent(w, closeEvent, delivered, subscription, lifecycle.ReconnectRetry())
+			case <-idle:
+				c.Logger().Printf("SSE client idle for %v, closing, ip: %v", idleTimeout, c.RealIP())
+				return writeSummary(w, delivered, subscription, "")
+			case now := <-heartbeat:
+				if err := writeHeartbeat(w, now, heartbeatEvents); err != nil {
+					return err
+				}
+				flush()
+			case <-flushTimer.C:
+				if unflushed > 0 {
+					flush()
+				}
+			case <-coalesced:
+				if pending := co.take(); pending != nil {
+					if err := send(*pending); err != nil {
+						return err
+					}
+				}
+			case <-ordered:
+				for _, event := range ord.ready(time.Now()) {
+					if err := deliver(event); err != nil {
+						return err
+					}
+				}
+			case signal := <-signals:
+				switch signal {
+				case signalPause:
+					paused.pause()
+				case signalResume:
+					for _, payload := range paused.resume() {
+						if err := receive(payload); err != nil {
+							return err
+						}
+					}
+				}
+			case payload := <-subscription.EventChan:
+				if paused.hold(payload) {
+					continue
+				}
+				if err := receive(payload); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// HeaderSubscriptionID tells a client the ID of its stream, which it needs to
+// ack events or pause and resume the stream.
+const HeaderSubscriptionID = "X-Subscription-ID"
+
+func setStreamHeaders(w *echo.Response) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+}
+
+// checkRequestSize rejects requests whose headers or query string are longer
+// than sse.max_header_bytes or sse.max_query_length, e.g. a token pasted
+// into the URL many times over. A limit of 0 disables the check.
+func checkRequestSize(r *http.Request) error {
+	if maxQuery := conf.SSE.MaxQueryLength; maxQuery > 0 && len(r.URL.RawQuery) > maxQuery {
+		return echo.NewHTTPError(http.StatusRequestURITooLong, "query string too long")
+	}
+
+	if maxHeader := conf.SSE.MaxHeaderBytes; maxHeader > 0 {
+		size := 0
+		for name, values := range r.Header {
+			for _, value := range values {
+				size += len(name) + len(value)
+			}
+		}
+		if size > maxHeader {
+			return echo.NewHTTPError(http.StatusRequestHeaderFieldsTooLarge, "request headers too large")
+		}
+	}
+	return nil
+}
+
+// limitBody rejects request bodies larger than server.max_body_bytes with a
+// 413 before any handler parses them. Bodies are small control messages, so
+// the limit is enforced by buffering them, which catches chunked bodies that
+// don't declare a length too.
+func limitBody() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			limit := conf.Server.MaxBodyBytes
+			req := c.Request()
+			if limit <= 0 || req.Body == nil || req.Body == http.NoBody {
+				return next(c)
+			}
+
+			if req.ContentLength > limit {
+				RejectedRequests.WithLabelValues("body_too_large").Inc()
+				return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "request body too large")
+			}
+			body, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+			req.Body.Close()
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "could not read request body")
+			}
+			if int64(len(body)) > limit {
+				RejectedRequests.WithLabelValues("body_too_large").Inc()
+				return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "request body too large")
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			return next(c)
+		}
+	}
+}
+
+// authError marks a subscription request that failed authentication, so each
+// transport can reject it in its own way.
+type authError struct {
+	err error
+}
+
+func (e *authError) Error() string { return e.err.Error() }
+func (e *authError) Unwrap() error { return e.err }
+
+// subscriptionFromRequest authenticates an /events style request and builds
+// the subscription described by its query params.
+func subscriptionFromRequest(c echo.Context) (Subscription, error) {
+	teamId := c.QueryParam("teamId")
+	eventType := c.QueryParam("eventType")
+	distinctId := c.QueryParam("distinctId")
+	geo := c.QueryParam("geo")
+
+	replay, err := parseReplayMode(c.QueryParam("replay"))
+	if err != nil {
+		return Subscription{}, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	properties, err := parsePropertyFilters(c.QueryParam("properties"))
+	if err != nil {
+		return Subscription{}, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	userSampleRate := 0.0
+	if rate := c.QueryParam("userSampleRate"); rate != "" {
+		userSampleRate, err = strconv.ParseFloat(rate, 64)
+		if err != nil || userSampleRate < 0 || userSampleRate > 1 {
+			return Subscription{}, echo.NewHTTPError(http.StatusBadRequest, "userSampleRate must be between 0 and 1")
+		}
+	}
+
+	activeHours, err := parseActiveHours(c.QueryParam("activeHours"), c.QueryParam("timezone"))
+	if err != nil {
+		return Subscription{}, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	var disconnectOnOverflow bool
+	switch overflow := c.QueryParam("overflow"); overflow {
+	case "", "drop":
+	case "disconnect":
+		disconnectOnOverflow = true
+	default:
+		return Subscription{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown overflow policy %q", overflow))
+	}
+
+	maxEventsPerSecond := 0.0
+	if limit := c.QueryParam("maxEventsPerSecond"); limit != "" {
+		maxEventsPerSecond, err = strconv.ParseFloat(limit, 64)
+		if err != nil || maxEventsPerSecond < 0 {
+			return Subscription{}, echo.NewHTTPError(http.StatusBadRequest, "maxEventsPerSecond must be a non-negative number")
+		}
+	}
+
+	teamIdInt := 0
+	token := ""
+	geoOnly := false
+
+	if strings.ToLower(geo) == "true" || geo == "1" {
+		geoOnly = true
+	} else {
+		teamId = ""
+
+		log.Println("~~~~ decoding auth token")
+		claims, err := decodeAuthFromRequest(c)
+		if err != nil {
+			return Subscription{}, &authError{err}
+		}
+		checkTokenExpiry(c, claims)
+		teamId = strconv.Itoa(int(claims["team_id"].(float64)))
+
+		log.Printf("~~~~ team found %s", teamId)
+		if teamId == "" {
+			return Subscription{}, errors.New("teamId is required unless geo=true")
+		}
+	}
+
+	if teamId != "" {
+		teamIdInt64, err := strconv.ParseInt(teamId, 10, 0)
+		if err != nil {
+			return Subscription{}, err
+		}
+
+		teamIdInt := int(teamIdInt64)
+		token, err = teamToken(teamIdInt)
+		if err != nil {
+			return Subscription{}, err
+		}
+		if err := validateAPIToken(token); err != nil {
+			return Subscription{}, &authError{err}
+		}
+	}
+
+	eventTypes := []string{}
+	if eventType != "" {
+		eventTypes = strings.Split(eventType, ",")
+	}
+
+	distinctIds := []string{}
+	if ids := c.QueryParam("distinctIds"); ids != "" {
+		distinctIds = strings.Split(ids, ",")
+	}
+
+	subscription := Subscription{
+		TeamId:      teamIdInt,
+		Token:       token,
+		ClientId:    newSubscriptionID(),
+		DistinctId:  distinctId,
+		DistinctIDs: distinctIds,
+		Geo:         geoOnly,
+		EventTypes:  eventTypes,
+		Properties:  properties,
+		Replay:      replay,
+		LastEventID: c.Request().Header.Get("Last-Event-ID"),
+		EventChan:   make(chan interface{}, 100),
+		ShouldClose: &atomic.Bool{},
+		Dropped:     &atomic.Int64{},
+		Revoked:     make(chan struct{}),
+		Reconnect:   make(chan time.Duration, 1),
+
+		UserSampleRate:       userSampleRate,
+		ActiveHours:          activeHours,
+		DisconnectOnOverflow: disconnectOnOverflow,
+		Overflowed:           make(chan struct{}),
+	}
+	return subscription.withRateLimit(maxEventsPerSecond), nil
+}
+
+// streamAuthError rejects an unauthenticated /events request. By default that's
+// a plain 401; with sse.auth_failure=event the stream is opened and a single
+// "auth_error" frame is sent before closing, which some SSE clients handle
+// better than a failed connection they keep retrying.
+func streamAuthError(c echo.Context, authErr error) error {
+	if conf.SSE.AuthFailure != "event" {
+		return echo.NewHTTPError(http.StatusUnauthorized, authErr.Error())
+	}
+
+	jsonData, err := json.Marshal(map[string]string{"error": authErr.Error()})
+	if err != nil {
+		return err
+	}
+
+	w := c.Response()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	event := Event{
+		Event: []byte("auth_error"),
+		Data:  jsonData,
+	}
+	if err := event.WriteTo(w); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// SubscriptionSummary is sent as a final "summary" frame when the server ends
+// a stream, so clients know whether they missed anything. Dropped is the
+// subscription's Dropped: events lost to a full buffer, the rate limit or a
+// full pause buffer alike.
+type SubscriptionSummary struct {
+	Delivered int64 `json:"delivered"`
+	Dropped   int64 `json:"dropped"`
+}
+
+func writeSummary(w *echo.Response, delivered int64, sub Subscription, retry string) error {
+	return writeSummaryEvent(w, "summary", delivered, sub, retry)
+}
+
+// writeSummaryEvent sends the delivered and dropped totals as an event named
+// name, e.g. "overflow" when the stream is closed because it fell behind.
+func writeSummaryEvent(w *echo.Response, name string, delivered int64, sub Subscription, retry string) error {
+	jsonData, err := json.Marshal(SubscriptionSummary{
+		Delivered: delivered,
+		Dropped:   sub.Dropped.Load(),
+	})
+	if err != nil {
+		return err
+	}
+
+	event := Event{
+		Event: []byte(name),
+		Data:  jsonData,
+		Retry: []byte(retry),
+	}
+	if err := event.WriteTo(w); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// writeGap tells the client that events between its Last-Event-ID and the
+// backfill that follows were skipped.
+func writeGap(w *echo.Response, gap ReplayGap) error {
+	jsonData, err := json.Marshal(gap)
+	if err != nil {
+		return err
+	}
+	event := Event{
+		Event: []byte("gap"),
+		Data:  jsonData,
+	}
+	if err := event.WriteTo(w); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// writeHeartbeat sends a heartbeat, either as an SSE comment or, with
+// asEvent, as a "heartbeat" event carrying the time it was sent.
+func writeHeartbeat(w *echo.Response, now time.Time, asEvent bool) error {
+	event := Event{Comment: []byte("heartbeat")}
+	if asEvent {
+		event = Event{
+			Event: []byte("heartbeat"),
+			Data:  []byte(fmt.Sprintf(`{"timestamp":%q}`, now.UTC().Format(time.RFC3339Nano))),
+		}
+	}
+	return event.WriteTo(w)
+}
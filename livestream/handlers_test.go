@@ -0,0 +1,959 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestAcquireConnection(t *testing.T) {
+	setConfig(t, "sse.max_connections", 1)
+	setConfig(t, "sse.retry_after", 5)
+
+	newContext := func() (echo.Context, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		return echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/ws", nil), rec), rec
+	}
+
+	c, _ := newContext()
+	release, err := acquireConnection(c)
+	if err != nil {
+		t.Fatalf("first connection rejected: %v", err)
+	}
+
+	c, rec := newContext()
+	if _, err := acquireConnection(c); err == nil {
+		t.Fatal("connection over sse.max_connections accepted")
+	}
+	if got := rec.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("Retry-After = %q, want 5", got)
+	}
+
+	release()
+	c, _ = newContext()
+	release, err = acquireConnection(c)
+	if err != nil {
+		t.Fatalf("connection rejected after a slot was released: %v", err)
+	}
+	release()
+}
+
+func TestWriteHeartbeat(t *testing.T) {
+	now := time.Date(2024, 9, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		asEvent bool
+		want    string
+	}{
+		{name: "comment", want: ": heartbeat\n\n"},
+		{name: "event", asEvent: true, want: "data: {\"timestamp\":\"2024-09-01T12:00:00Z\"}\nevent: heartbeat\n\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			if err := writeHeartbeat(echo.NewResponse(rec, echo.New()), now, tt.asEvent); err != nil {
+				t.Fatalf("writeHeartbeat() error: %v", err)
+			}
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// flushRecorder is an http.ResponseWriter that counts flushes and remembers
+// how much of the body had been flushed, so a test only sees what a client
+// would have received.
+type flushRecorder struct {
+	mu      sync.Mutex
+	header  http.Header
+	body    bytes.Buffer
+	flushed int
+	flushes int
+}
+
+func (r *flushRecorder) Header() http.Header { return r.header }
+func (r *flushRecorder) WriteHeader(int)     {}
+
+func (r *flushRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.body.Write(p)
+}
+
+func (r *flushRecorder) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushed = r.body.Len()
+	r.flushes++
+}
+
+// received returns how many events had been flushed to the client, and in
+// how many flushes.
+func (r *flushRecorder) received() (events int, flushes int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return bytes.Count(r.body.Bytes()[:r.flushed], []byte("data: ")), r.flushes
+}
+
+// subscriptionNotifier hands each new subscription to the test.
+type subscriptionNotifier chan Subscription
+
+func (n subscriptionNotifier) OnSubscribe(sub Subscription) { n <- sub }
+func (n subscriptionNotifier) OnUnsubscribe(Subscription)   {}
+
+// streamGeoEvents opens a geo stream, which needs no auth, sends it n events
+// and returns how many flushes it took to deliver them all.
+func streamGeoEvents(tb testing.TB, n int) int {
+	tb.Helper()
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent))
+	subscribed := make(subscriptionNotifier, 1)
+	filter.SetObserver(subscribed)
+	go filter.Run()
+	defer filter.Stop()
+
+	handler := StreamEventsHandler(filter, NewLifecycle(), NewAckRegistry(), NewSubscriptionControls())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/events?geo=true", nil).WithContext(ctx)
+	rec := &flushRecorder{header: make(http.Header)}
+	done := make(chan error, 1)
+	go func() { done <- handler(echo.New().NewContext(req, rec)) }()
+
+	var sub Subscription
+	select {
+	case sub = <-subscribed:
+	case <-time.After(time.Second):
+		tb.Fatal("stream didn't subscribe")
+	}
+
+	for i := 0; i < n; i++ {
+		// Don't outrun the stream, or events would be dropped.
+		for len(sub.EventChan) > cap(sub.EventChan)/2 {
+			time.Sleep(10 * time.Microsecond)
+		}
+		filter.inboundChan <- PostHogEvent{Token: "token", Lat: 52.5, Lng: 13.4}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events, flushes := rec.received()
+		if events == n {
+			cancel()
+			<-done
+			return flushes
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("client received %d of %d events", events, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlushBatching(t *testing.T) {
+	const events = 500
+	tests := []struct {
+		name          string
+		flushInterval time.Duration
+		flushMax      int
+		maxFlushes    int
+	}{
+		{name: "flush after every event", maxFlushes: events},
+		{name: "flush every 10 events", flushInterval: time.Second, flushMax: 10, maxFlushes: events / 10},
+		{name: "flush on interval", flushInterval: 10 * time.Millisecond, maxFlushes: events - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, "sse.flush_interval", tt.flushInterval)
+			setConfig(t, "sse.flush_max_events", tt.flushMax)
+
+			if flushes := streamGeoEvents(t, events); flushes > tt.maxFlushes {
+				t.Errorf("%d flushes for %d events, want at most %d", flushes, events, tt.maxFlushes)
+			}
+		})
+	}
+}
+
+func BenchmarkFlushBatching(b *testing.B) {
+	for _, bench := range []struct {
+		name          string
+		flushInterval time.Duration
+		flushMax      int
+	}{
+		{name: "immediate"},
+		{name: "10ms or 100 events", flushInterval: 10 * time.Millisecond, flushMax: 100},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			setConfig(b, "sse.flush_interval", bench.flushInterval)
+			setConfig(b, "sse.flush_max_events", bench.flushMax)
+
+			flushes := streamGeoEvents(b, b.N)
+			b.ReportMetric(float64(flushes)/float64(b.N), "flushes/event")
+		})
+	}
+}
+
+func TestWriteStatsETag(t *testing.T) {
+	ts := newTestTeamStats()
+	ts.add(PostHogEvent{Token: "token", DistinctId: "alice", Event: "$pageview"})
+
+	get := func(target, ifNoneMatch, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		req.Header.Set(echo.HeaderAccept, accept)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		if err := writeStats(c, ts.response(c, "token")); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	first := get("/stats", "", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first request got %d with ETag %q, want 200 with an ETag", first.Code, etag)
+	}
+
+	tests := []struct {
+		name        string
+		target      string
+		ifNoneMatch string
+		accept      string
+		change      func()
+		wantStatus  int
+		wantNewETag bool
+	}{
+		{name: "unchanged", target: "/stats", ifNoneMatch: etag, wantStatus: http.StatusNotModified},
+		{name: "listed among others", target: "/stats", ifNoneMatch: `W/"0", ` + etag, wantStatus: http.StatusNotModified},
+		{name: "strong form of the weak tag", target: "/stats", ifNoneMatch: etag[len("W/"):], wantStatus: http.StatusNotModified},
+		{name: "other tag", target: "/stats", ifNoneMatch: `W/"0"`, wantStatus: http.StatusOK},
+		{name: "protobuf", target: "/stats", ifNoneMatch: etag, accept: ProtobufContentType, wantStatus: http.StatusOK, wantNewETag: true},
+		{name: "other fields included", target: "/stats?include=events", ifNoneMatch: etag, wantStatus: http.StatusOK, wantNewETag: true},
+		{
+			name:        "user count changed",
+			target:      "/stats",
+			ifNoneMatch: etag,
+			change: func() {
+				ts.add(PostHogEvent{Token: "token", DistinctId: "bob", Event: "$pageview"})
+			},
+			wantStatus:  http.StatusOK,
+			wantNewETag: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.change != nil {
+				tt.change()
+			}
+			rec := get(tt.target, tt.ifNoneMatch, tt.accept)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Code == http.StatusNotModified && rec.Body.Len() > 0 {
+				t.Errorf("304 carried a %d byte body", rec.Body.Len())
+			}
+			if got := rec.Header().Get("ETag"); (got != etag) != tt.wantNewETag {
+				t.Errorf("ETag %s, first response had %s", got, etag)
+			}
+		})
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	setConfig(t, "server.max_body_bytes", 8)
+
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantStatus    int
+	}{
+		{name: "within the limit", body: "12345678", contentLength: 8, wantStatus: http.StatusOK},
+		{name: "declared too large", body: "123456789", contentLength: 9, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "chunked and too large", body: "123456789", contentLength: -1, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "chunked within the limit", body: "1234", contentLength: -1, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/ack", strings.NewReader(tt.body))
+			req.ContentLength = tt.contentLength
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			var read string
+			err := limitBody()(func(c echo.Context) error {
+				body, err := io.ReadAll(c.Request().Body)
+				read = string(body)
+				return err
+			})(c)
+
+			status := http.StatusOK
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("got %d, want %d", status, tt.wantStatus)
+			}
+			if status == http.StatusOK && read != tt.body {
+				t.Errorf("handler read %q, want %q", read, tt.body)
+			}
+		})
+	}
+}
+
+func TestStreamIgnoresClientRequestID(t *testing.T) {
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent))
+	subscribed := make(subscriptionNotifier, 2)
+	filter.SetObserver(subscribed)
+	go filter.Run()
+	defer filter.Stop()
+
+	sink := newTestSubscription(newSubscriptionID(), "token")
+	filter.Subscribe(sink)
+	<-subscribed
+
+	// A client naming the sink's ID as its request ID must neither get that
+	// ID nor take the sink down with it when it disconnects.
+	handler := middleware.RequestID()(StreamEventsHandler(filter, NewLifecycle(), NewAckRegistry(), NewSubscriptionControls()))
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/events?geo=true", nil).WithContext(ctx)
+	req.Header.Set(echo.HeaderXRequestID, sink.ClientId)
+	rec := &flushRecorder{header: make(http.Header)}
+	done := make(chan error, 1)
+	go func() { done <- handler(echo.New().NewContext(req, rec)) }()
+
+	var stream Subscription
+	select {
+	case stream = <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("stream didn't subscribe")
+	}
+	if stream.ClientId == sink.ClientId {
+		t.Error("stream took its ID from X-Request-ID")
+	}
+	cancel()
+	<-done
+	if got := rec.Header().Get(HeaderSubscriptionID); got != stream.ClientId {
+		t.Errorf("%s = %q, want %q", HeaderSubscriptionID, got, stream.ClientId)
+	}
+
+	filter.inboundChan <- PostHogEvent{Token: "token", Uuid: "after"}
+	select {
+	case <-sink.EventChan:
+	case <-time.After(time.Second):
+		t.Error("the sink was unsubscribed along with the stream")
+	}
+}
+
+func TestStreamSummary(t *testing.T) {
+	setConfig(t, "sse.idle_timeout", 100*time.Millisecond)
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent))
+	subscribed := make(subscriptionNotifier, 1)
+	filter.SetObserver(subscribed)
+	go filter.Run()
+	defer filter.Stop()
+
+	handler := StreamEventsHandler(filter, NewLifecycle(), NewAckRegistry(), NewSubscriptionControls())
+	req := httptest.NewRequest(http.MethodGet, "/events?geo=true", nil)
+	rec := &flushRecorder{header: make(http.Header)}
+	done := make(chan error, 1)
+	go func() { done <- handler(echo.New().NewContext(req, rec)) }()
+
+	var sub Subscription
+	select {
+	case sub = <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("stream didn't subscribe")
+	}
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			filter.inboundChan <- PostHogEvent{Token: "token", Lat: 52.5, Lng: 13.4}
+		}
+	}
+	waitForEmpty := func() {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for len(sub.EventChan) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("stream didn't take its events, %d left", len(sub.EventChan))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	send(3)
+	for events, _ := rec.received(); events < 3; events, _ = rec.received() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Stall the client so its buffer fills up: one event is held by the
+	// stalled write, the buffer takes as many again as it can hold, and the
+	// rest are dropped.
+	rec.mu.Lock()
+	send(1)
+	waitForEmpty()
+	send(cap(sub.EventChan) + 5)
+	rec.mu.Unlock()
+
+	// The stream goes idle once it has caught up and is closed with a summary.
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("stream returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle stream wasn't closed")
+	}
+
+	rec.mu.Lock()
+	body := rec.body.String()
+	rec.mu.Unlock()
+	frames := strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n")
+	last := frames[len(frames)-1]
+	data, ok := strings.CutPrefix(last, "data: ")
+	if !ok || !strings.HasSuffix(data, "\nevent: summary") {
+		t.Fatalf("last frame is %q, want a summary", last)
+	}
+	var summary SubscriptionSummary
+	if err := json.Unmarshal([]byte(strings.TrimSuffix(data, "\nevent: summary")), &summary); err != nil {
+		t.Fatal(err)
+	}
+	want := SubscriptionSummary{Delivered: int64(3 + 1 + cap(sub.EventChan)), Dropped: 5}
+	if summary != want {
+		t.Errorf("summary = %+v, want %+v", summary, want)
+	}
+}
+
+func TestStatsResponseShape(t *testing.T) {
+	ts := newTestTeamStats()
+	for _, event := range []PostHogEvent{
+		{Token: "token", DistinctId: "alice", Event: "$pageview"},
+		{Token: "token", DistinctId: "bob", Event: "$pageview"},
+		{Token: "token", DistinctId: "alice", Event: "$autocapture"},
+	} {
+		ts.add(event)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		token  string
+		want   map[string]interface{}
+	}{
+		{
+			name:   "users only by default",
+			target: "/stats",
+			token:  "token",
+			want:   map[string]interface{}{"users_on_product": 2.0},
+		},
+		{
+			name:   "every optional field",
+			target: "/stats?include=events,breakdown,peak,rate,group",
+			token:  "token",
+			want: map[string]interface{}{
+				"users_on_product":       2.0,
+				"events":                 3.0,
+				"breakdown":              map[string]interface{}{"$pageview": 2.0, "$autocapture": 1.0},
+				"users_peak":             2.0,
+				"events_per_minute":      3.0,
+				"group_users_on_product": 2.0,
+			},
+		},
+		{
+			name:   "unknown token",
+			target: "/stats?include=events",
+			token:  "other",
+			want:   map[string]interface{}{"error": "no stats"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, tt.target, nil), httptest.NewRecorder())
+			body, err := json.Marshal(ts.response(c, tt.token))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("response = %s, want %v", body, tt.want)
+			}
+		})
+	}
+}
+
+// geoStream is a geo stream, which needs no auth, served by a filter of its
+// own.
+type geoStream struct {
+	filter *Filter
+	sub    Subscription
+	rec    *flushRecorder
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// openGeoStream opens /events?geo=true plus query and waits for it to
+// subscribe.
+func openGeoStream(t *testing.T, query string) *geoStream {
+	t.Helper()
+	s := &geoStream{
+		filter: NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent)),
+		rec:    &flushRecorder{header: make(http.Header)},
+		done:   make(chan error, 1),
+	}
+	subscribed := make(subscriptionNotifier, 1)
+	s.filter.SetObserver(subscribed)
+	go s.filter.Run()
+	t.Cleanup(s.filter.Stop)
+
+	handler := StreamEventsHandler(s.filter, NewLifecycle(), NewAckRegistry(), NewSubscriptionControls())
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	t.Cleanup(s.cancel)
+	req := httptest.NewRequest(http.MethodGet, "/events?geo=true"+query, nil).WithContext(ctx)
+	go func() { s.done <- handler(echo.New().NewContext(req, s.rec)) }()
+
+	select {
+	case s.sub = <-subscribed:
+	case err := <-s.done:
+		t.Fatalf("stream returned %v instead of subscribing", err)
+	case <-time.After(time.Second):
+		t.Fatal("stream didn't subscribe")
+	}
+	return s
+}
+
+// close hangs up and returns what the handler returned.
+func (s *geoStream) close() error {
+	s.cancel()
+	return <-s.done
+}
+
+func TestReconnectAfterHeader(t *testing.T) {
+	tests := []struct {
+		name           string
+		reconnectAfter time.Duration
+		want           string
+	}{
+		{name: "configured", reconnectAfter: 90 * time.Second, want: "90"},
+		{name: "off by default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, "sse.reconnect_after", tt.reconnectAfter)
+			stream := openGeoStream(t, "")
+			if err := stream.close(); err != nil {
+				t.Fatalf("stream returned %v", err)
+			}
+			if got := stream.rec.Header().Get("X-Reconnect-After"); got != tt.want {
+				t.Errorf("X-Reconnect-After = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdleStreamIsClosed(t *testing.T) {
+	setConfig(t, "sse.heartbeat_interval", 0)
+	setConfig(t, "sse.idle_timeout", 50*time.Millisecond)
+	stream := openGeoStream(t, "")
+
+	select {
+	case err := <-stream.done:
+		if err != nil {
+			t.Errorf("idle stream returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle stream wasn't closed")
+	}
+	if events, _ := stream.rec.received(); events != 1 {
+		t.Errorf("client received %d frames, want only the summary", events)
+	}
+}
+
+func TestIdleTimeoutIsOptIn(t *testing.T) {
+	setConfig(t, "sse.heartbeat_interval", 0)
+	stream := openGeoStream(t, "")
+
+	select {
+	case err := <-stream.done:
+		t.Fatalf("stream closed with %v although sse.idle_timeout isn't set", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	stream.close()
+}
+
+func TestStreamAuthFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "status by default", wantStatus: http.StatusUnauthorized},
+		{name: "status", mode: "status", wantStatus: http.StatusUnauthorized},
+		{name: "event", mode: "event", wantBody: "data: {\"error\":\"authorization header is required\"}\nevent: auth_error\n\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, "sse.auth_failure", tt.mode)
+			filter, _ := newTestFilter(t)
+			handler := StreamEventsHandler(filter, NewLifecycle(), NewAckRegistry(), NewSubscriptionControls())
+			rec := httptest.NewRecorder()
+			err := handler(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/events", nil), rec))
+
+			if tt.wantStatus != 0 {
+				var httpErr *echo.HTTPError
+				if !errors.As(err, &httpErr) || httpErr.Code != tt.wantStatus {
+					t.Fatalf("handler returned %v, want a %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handler returned %v, want the stream opened", err)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "text/event-stream" {
+				t.Errorf("Content-Type = %q, want text/event-stream", got)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSubscriptionSetupDuration(t *testing.T) {
+	observations := func() uint64 {
+		var m dto.Metric
+		if err := SubscriptionSetupDuration.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	before := observations()
+
+	for i := 0; i < 3; i++ {
+		openGeoStream(t, "").close()
+	}
+	if got := observations() - before; got != 3 {
+		t.Errorf("setup duration observed %d times for 3 connections, want once each", got)
+	}
+}
+
+// authenticateTeams makes requests signed by authorizeTeam resolve team ids
+// to the project tokens in tokens, without Postgres.
+func authenticateTeams(t *testing.T, tokens map[int]string) {
+	t.Helper()
+	setConfig(t, "jwt.secret", "secret")
+	setConfig(t, "jwt.secrets", []string{})
+	saved := teamToken
+	teamToken = func(teamId int) (string, error) { return tokens[teamId], nil }
+	t.Cleanup(func() { teamToken = saved })
+}
+
+// authorizeTeam signs req for teamId, see authenticateTeams.
+func authorizeTeam(t *testing.T, req *http.Request, teamId int) *http.Request {
+	t.Helper()
+	exp := time.Now().Add(time.Hour).Unix()
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, "secret", jwt.MapClaims{"aud": ExpectedScope, "team_id": teamId, "exp": exp}))
+	return req
+}
+
+func TestStatsQueries(t *testing.T) {
+	authenticateTeams(t, map[int]string{1: "phc_first", 2: "phc_second"})
+	setConfig(t, "metrics.token_buckets", 1000)
+
+	first, second := tokenBucket("phc_first"), tokenBucket("phc_second")
+	if first == second {
+		t.Fatalf("test tokens share bucket %s", first)
+	}
+	queries := func(bucket string) float64 {
+		return testutil.ToFloat64(StatsQueries.WithLabelValues(bucket))
+	}
+	before := map[string]float64{first: queries(first), second: queries(second)}
+
+	handler := StatsHandler(newTestTeamStats())
+	query := func(teamId int) {
+		req := authorizeTeam(t, httptest.NewRequest(http.MethodGet, "/stats", nil), teamId)
+		if err := handler(echo.New().NewContext(req, httptest.NewRecorder())); err != nil {
+			t.Fatalf("stats query returned %v", err)
+		}
+	}
+	query(1)
+	query(1)
+	query(2)
+
+	if got := queries(first) - before[first]; got != 2 {
+		t.Errorf("first token's bucket counted %v queries, want 2", got)
+	}
+	if got := queries(second) - before[second]; got != 1 {
+		t.Errorf("second token's bucket counted %v queries, want 1", got)
+	}
+}
+
+func TestStatsStream(t *testing.T) {
+	authenticateTeams(t, map[int]string{1: "token"})
+	setConfig(t, "stats.stream_interval", 10*time.Millisecond)
+	ts := newTestTeamStats()
+	ts.add(PostHogEvent{Token: "token", DistinctId: "alice", Event: "$pageview"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := authorizeTeam(t, httptest.NewRequest(http.MethodGet, "/stats/stream?include=events", nil).WithContext(ctx), 1)
+	rec := &flushRecorder{header: make(http.Header)}
+	done := make(chan error, 1)
+	go func() { done <- StatsStreamHandler(ts, NewLifecycle())(echo.New().NewContext(req, rec)) }()
+
+	// frames returns the stats frames flushed so far.
+	frames := func() []StatsResponse {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		var stats []StatsResponse
+		for _, frame := range strings.Split(string(rec.body.Bytes()[:rec.flushed]), "\n\n") {
+			if frame == "" {
+				continue
+			}
+			var data string
+			for _, line := range strings.Split(frame, "\n") {
+				if after, ok := strings.CutPrefix(line, "data: "); ok {
+					data = after
+				} else if line != "event: stats" {
+					t.Fatalf("unexpected line %q in frame %q", line, frame)
+				}
+			}
+			var resp StatsResponse
+			if err := json.Unmarshal([]byte(data), &resp); err != nil {
+				t.Fatalf("frame %q doesn't hold stats: %v", frame, err)
+			}
+			stats = append(stats, resp)
+		}
+		return stats
+	}
+	latest := func() StatsResponse {
+		stats := frames()
+		return stats[len(stats)-1]
+	}
+
+	waitFor(t, "the first stats frame", func() bool { return len(frames()) > 0 })
+	if got := latest(); got.UsersOnProduct != 1 || got.Events == nil || *got.Events != 1 {
+		t.Errorf("first frame = %+v, want 1 user and 1 event", got)
+	}
+
+	ts.add(PostHogEvent{Token: "token", DistinctId: "bob", Event: "$pageview"})
+	waitFor(t, "a frame counting the new user", func() bool { return latest().UsersOnProduct == 2 })
+	if got := latest(); got.Events == nil || *got.Events != 2 {
+		t.Errorf("frame = %+v, want 2 events", got)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("stream returned %v on disconnect", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("stream kept running after the client disconnected")
+	}
+}
+
+func TestStreamRequestSize(t *testing.T) {
+	setConfig(t, "sse.max_header_bytes", 1024)
+	setConfig(t, "sse.max_query_length", 256)
+
+	tests := []struct {
+		name       string
+		query      string
+		header     string
+		wantStatus int
+	}{
+		{name: "oversized header", header: strings.Repeat("x", 1024), wantStatus: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "oversized query string", query: "&eventType=" + strings.Repeat("x", 256), wantStatus: http.StatusRequestURITooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, _ := newTestFilter(t)
+			handler := StreamEventsHandler(filter, NewLifecycle(), NewAckRegistry(), NewSubscriptionControls())
+			req := httptest.NewRequest(http.MethodGet, "/events?geo=true"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set("X-Padding", tt.header)
+			}
+
+			var httpErr *echo.HTTPError
+			if err := handler(echo.New().NewContext(req, httptest.NewRecorder())); !errors.As(err, &httpErr) || httpErr.Code != tt.wantStatus {
+				t.Errorf("handler returned %v, want a %d", err, tt.wantStatus)
+			}
+		})
+	}
+
+	t.Run("within the limits", func(t *testing.T) {
+		// openGeoStream fails the test unless the stream subscribes.
+		openGeoStream(t, "&eventType=$pageview").close()
+	})
+}
+
+func TestPeakUsers(t *testing.T) {
+	ts := newTestTeamStats()
+	ts.TokenTTLs = map[string]time.Duration{"token": 20 * time.Millisecond}
+	for _, distinctId := range []string{"alice", "bob", "carol"} {
+		ts.add(PostHogEvent{Token: "token", DistinctId: distinctId, Event: "$pageview"})
+	}
+	waitFor(t, "the first users to expire", func() bool { return ts.Store["token"].Len() == 0 })
+	ts.add(PostHogEvent{Token: "token", DistinctId: "dave", Event: "$pageview"})
+
+	stats := func(target string) StatsResponse {
+		return ts.response(echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), httptest.NewRecorder()), "token")
+	}
+	got := stats("/stats?include=peak")
+	if got.UsersOnProduct != 1 || got.UsersPeak == nil || *got.UsersPeak != 3 {
+		t.Errorf("response = %+v, want 1 current user and a peak of 3", got)
+	}
+	if got := stats("/stats"); got.UsersPeak != nil {
+		t.Errorf("users_peak = %d without include=peak", *got.UsersPeak)
+	}
+
+	// Once the peak window has passed the peak starts over.
+	ts.PeakWindow = 0
+	ts.add(PostHogEvent{Token: "token", DistinctId: "dave", Event: "$pageview"})
+	if got := stats("/stats?include=peak"); got.UsersPeak == nil || *got.UsersPeak != 1 {
+		t.Errorf("response = %+v after the peak window, want a peak of 1", got)
+	}
+}
+
+func TestTokensNearExpiry(t *testing.T) {
+	authenticateTeams(t, map[int]string{1: "phc_token"})
+	setConfig(t, "jwt.near_expiry_threshold", 5*time.Minute)
+	filter, _ := newTestFilter(t)
+	handler := StreamEventsHandler(filter, NewLifecycle(), NewAckRegistry(), NewSubscriptionControls())
+
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		want      float64
+	}{
+		{name: "near expiry", expiresIn: 30 * time.Second, want: 1},
+		{name: "long-lived", expiresIn: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(TokensNearExpiry)
+
+			// The client hangs up straight away; only connecting matters.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			req := httptest.NewRequest(http.MethodGet, "/events", nil).WithContext(ctx)
+			exp := time.Now().Add(tt.expiresIn).Unix()
+			req.Header.Set("Authorization", "Bearer "+signTestToken(t, "secret", jwt.MapClaims{"aud": ExpectedScope, "team_id": 1, "exp": exp}))
+			if err := handler(echo.New().NewContext(req, httptest.NewRecorder())); err != nil {
+				t.Fatalf("stream returned %v", err)
+			}
+
+			if got := testutil.ToFloat64(TokensNearExpiry) - before; got != tt.want {
+				t.Errorf("counted %v tokens near expiry, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeadEvents(t *testing.T) {
+	filter, observer := newTestFilter(t)
+	handler := StreamEventsHandler(filter, NewLifecycle(), NewAckRegistry(), NewSubscriptionControls())
+	rec := httptest.NewRecorder()
+	if err := handler(echo.New().NewContext(httptest.NewRequest(http.MethodHead, "/events", nil), rec)); err != nil {
+		t.Fatalf("HEAD returned %v", err)
+	}
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("body = %q, want none", rec.Body)
+	}
+
+	// The filter handles subscriptions in order, so if HEAD had subscribed
+	// it would be recorded before this one.
+	filter.Subscribe(newTestSubscription("after", "token"))
+	if got := observer.waitFor(t, 1); !reflect.DeepEqual(got, []string{"+after"}) {
+		t.Errorf("observer saw %v, want HEAD not to subscribe", got)
+	}
+}
+
+func TestSlowRequestHeaders(t *testing.T) {
+	setConfig(t, "server.read_header_timeout", 50*time.Millisecond)
+	filter, observer := newTestFilter(t)
+
+	// Served the way main serves it.
+	e := echo.New()
+	e.Server.ReadHeaderTimeout = conf.Server.ReadHeaderTimeout
+	e.Server.Handler = e
+	e.GET("/events", StreamEventsHandler(filter, NewLifecycle(), NewAckRegistry(), NewSubscriptionControls()))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Server.Serve(ln)
+	t.Cleanup(func() { e.Server.Close() })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Trickle the headers in a byte at a time until the server hangs up.
+	start := time.Now()
+	request := "GET /events?geo=true HTTP/1.1\r\nHost: livestream\r\nUser-Agent: " + strings.Repeat("slow", 100) + "\r\n\r\n"
+	for i := 0; i < len(request); i++ {
+		if _, err := conn.Write([]byte{request[i]}); err != nil {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("server was still reading headers after a second")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("connection wasn't closed: %v", err)
+	}
+	if strings.Contains(string(response), "200 OK") {
+		t.Errorf("slow client was answered %q, want the connection dropped", response)
+	}
+
+	filter.Subscribe(newTestSubscription("after", "token"))
+	if got := observer.waitFor(t, 1); !reflect.DeepEqual(got, []string{"+after"}) {
+		t.Errorf("observer saw %v, want the slow client not to subscribe", got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import "fmt"
+
+const (
+	// OverflowBlock stops accepting events while the queue is full, pushing
+	// back on ingestion.
+	OverflowBlock = "block"
+	// OverflowDropOldest discards the oldest queued event to make room.
+	OverflowDropOldest = "drop_oldest"
+	// OverflowDropNewest discards the incoming event.
+	OverflowDropNewest = "drop_newest"
+)
+
+// IngestionQueue is a bounded queue between ingestion and the filter. It
+// absorbs bursts that fan-out can't keep up with, and once full applies its
+// overflow policy instead of growing without bound.
+type IngestionQueue struct {
+	inboundChan  chan PostHogEvent
+	outboundChan chan PostHogEvent
+	policy       string
+
+	events []PostHogEvent
+	head   int
+	size   int
+}
+
+func NewIngestionQueue(inboundChan chan PostHogEvent, outboundChan chan PostHogEvent, capacity int, policy string) (*IngestionQueue, error) {
+	switch policy {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", policy)
+	}
+	if capacity <= 0 {
+		return nil, fmt.Errorf("queue capacity must be positive, got %d", capacity)
+	}
+
+	return &IngestionQueue{
+		inboundChan:  inboundChan,
+		outboundChan: outboundChan,
+		policy:       policy,
+		events:       make([]PostHogEvent, capacity),
+	}, nil
+}
+
+func (q *IngestionQueue) Run() {
+	for {
+		inbound := q.inboundChan
+		if q.size == len(q.events) && q.policy == OverflowBlock {
+			inbound = nil
+		}
+
+		var outbound chan PostHogEvent
+		var next PostHogEvent
+		if q.size > 0 {
+			outbound = q.outboundChan
+			next = q.events[q.head]
+		}
+
+		select {
+		case event, ok := <-inbound:
+			if !ok {
+				q.drain()
+				return
+			}
+			q.push(event)
+		case outbound <- next:
+			q.pop()
+		}
+		IngestionQueueDepth.Set(float64(q.size))
+	}
+}
+
+func (q *IngestionQueue) push(event PostHogEvent) {
+	if q.size == len(q.events) {
+		if q.policy == OverflowDropNewest {
+			EventsDropped.WithLabelValues("queue_full").Inc()
+			return
+		}
+		// OverflowDropOldest; a blocking queue never pushes while full.
+		q.pop()
+		EventsDropped.WithLabelValues("queue_full").Inc()
+	}
+	q.events[(q.head+q.size)%len(q.events)] = event
+	q.size++
+}
+
+func (q *IngestionQueue) pop() {
+	q.events[q.head] = PostHogEvent{}
+	q.head = (q.head + 1) % len(q.events)
+	q.size--
+}
+
+// drain hands over what is still queued once ingestion has stopped.
+func (q *IngestionQueue) drain() {
+	for q.size > 0 {
+		q.outboundChan <- q.events[q.head]
+		q.pop()
+		IngestionQueueDepth.Set(float64(q.size))
+	}
+}
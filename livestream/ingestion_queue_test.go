@@ -0,0 +1,79 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func queuedUUIDs(q *IngestionQueue) []string {
+	var uuids []string
+	for i := 0; i < q.size; i++ {
+		uuids = append(uuids, q.events[(q.head+i)%len(q.events)].Uuid)
+	}
+	return uuids
+}
+
+func TestIngestionQueueDropPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{policy: OverflowDropOldest, want: []string{"3", "4"}},
+		{policy: OverflowDropNewest, want: []string{"1", "2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			q, err := NewIngestionQueue(nil, nil, 2, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, event := range testEvents("1", "2", "3", "4") {
+				q.push(event)
+			}
+			if got := queuedUUIDs(q); !slices.Equal(got, tt.want) {
+				t.Errorf("queued %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIngestionQueueBlocksWhenFull(t *testing.T) {
+	inbound := make(chan PostHogEvent)
+	outbound := make(chan PostHogEvent)
+	q, err := NewIngestionQueue(inbound, outbound, 2, OverflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go q.Run()
+
+	events := testEvents("1", "2", "3")
+	inbound <- events[0]
+	inbound <- events[1]
+	select {
+	case inbound <- events[2]:
+		t.Fatal("a full blocking queue accepted another event")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Taking one event out makes room for the one that was held back.
+	got := []string{(<-outbound).Uuid}
+	inbound <- events[2]
+	close(inbound)
+	for len(got) < len(events) {
+		got = append(got, (<-outbound).Uuid)
+	}
+	if want := []string{"1", "2", "3"}; !slices.Equal(got, want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+}
+
+func TestNewIngestionQueueRejectsUnknownPolicy(t *testing.T) {
+	if _, err := NewIngestionQueue(nil, nil, 2, "drop_all"); err == nil {
+		t.Error("NewIngestionQueue accepted an unknown policy")
+	}
+	if _, err := NewIngestionQueue(nil, nil, 0, OverflowBlock); err == nil {
+		t.Error("NewIngestionQueue accepted a zero capacity")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+var (
+	instanceIDOnce sync.Once
+	instanceID     string
+)
+
+// InstanceID identifies this node: instance.id if configured, otherwise the
+// hostname (the pod name on Kubernetes), otherwise a random ID for the life
+// of the process.
+func InstanceID() string {
+	instanceIDOnce.Do(func() {
+		instanceID = conf.Instance.ID
+		if instanceID == "" {
+			instanceID, _ = os.Hostname()
+		}
+		if instanceID == "" {
+			instanceID = uuid.Must(uuid.NewV4()).String()
+		}
+	})
+	return instanceID
+}
@@ -4,9 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt"
-	"github.com/spf13/viper"
+	"github.com/labstack/echo/v4"
 )
 
 const ExpectedScope = "posthog:livestream"
@@ -24,15 +25,97 @@ func decodeAuthToken(authHeader string) (jwt.MapClaims, error) {
 		return nil, fmt.Errorf("authorization header format must be 'Bearer {token}'")
 	}
 
-	// Parse the token.
-	token, err := jwt.Parse(bearerToken[1], func(token *jwt.Token) (interface{}, error) {
-		// Make sure the token's signature algorithm isn't 'none'
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	return parseAuthToken(bearerToken[1])
+}
+
+// decodeAuthFromRequest reads the JWT from the Authorization header and, if
+// that is missing, from the cookie named by jwt.cookie_name (for same-site
+// browser embeds). The header always takes precedence. The cookie value is a
+// credential, so it must never be logged.
+func decodeAuthFromRequest(c echo.Context) (jwt.MapClaims, error) {
+	if authHeader := c.Request().Header.Get("Authorization"); authHeader != "" {
+		return decodeAuthToken(authHeader)
+	}
+
+	if cookieName := conf.JWT.CookieName; cookieName != "" {
+		if cookie, err := c.Cookie(cookieName); err == nil && cookie.Value != "" {
+			return parseAuthToken(cookie.Value)
 		}
-		// Here you should specify the secret used to sign your JWTs.
-		return []byte(viper.GetString("jwt.secret")), nil
-	})
+	}
+
+	return nil, errors.New("authorization header is required")
+}
+
+// tokenFromRequest authenticates a request about an existing stream, such as
+// an ack, with the same JWT the stream was opened with, and returns the token
+// of the project it grants access to. Authentication failures are returned as
+// an *authError.
+func tokenFromRequest(c echo.Context) (string, error) {
+	claims, err := decodeAuthFromRequest(c)
+	if err != nil {
+		return "", &authError{err}
+	}
+	teamId, ok := claims["team_id"].(float64)
+	if !ok {
+		return "", &authError{errors.New("token has no team_id")}
+	}
+	return teamToken(int(teamId))
+}
+
+// jwtSecrets returns the HS256 secrets tokens may be signed with. During a
+// rotation jwt.secrets lists both the new and the old secret; otherwise the
+// single jwt.secret is used.
+func jwtSecrets() []string {
+	if secrets := conf.JWT.Secrets; len(secrets) > 0 {
+		return secrets
+	}
+	return []string{conf.JWT.Secret}
+}
+
+// jwtIssuers maps each issuer on jwt.issuers to the secret its tokens are
+// signed with. It is set once at startup by setJWTIssuers; jwt.issuers is a
+// list rather than a map because viper lowercases map keys.
+var jwtIssuers map[string]string
+
+func setJWTIssuers(entries []JWTIssuer) {
+	jwtIssuers = make(map[string]string, len(entries))
+	for _, entry := range entries {
+		jwtIssuers[entry.Issuer] = entry.Secret
+	}
+}
+
+func parseAuthToken(tokenString string) (jwt.MapClaims, error) {
+	// When issuers are configured the token's iss claim picks the secret and
+	// tokens from any other issuer are rejected.
+	issuers := jwtIssuers
+
+	var token *jwt.Token
+	var err error
+	for _, secret := range jwtSecrets() {
+		// Parse the token.
+		token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			// Make sure the token's signature algorithm isn't 'none'
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			if len(issuers) > 0 {
+				claims, _ := token.Claims.(jwt.MapClaims)
+				issuer, _ := claims["iss"].(string)
+				issuerSecret, ok := issuers[issuer]
+				if !ok {
+					return nil, fmt.Errorf("unknown issuer %q", issuer)
+				}
+				return []byte(issuerSecret), nil
+			}
+			return []byte(secret), nil
+		})
+
+		// Only a bad signature is worth retrying with the next secret.
+		var validationErr *jwt.ValidationError
+		if len(issuers) > 0 || err == nil || !errors.As(err, &validationErr) || validationErr.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+			break
+		}
+	}
 
 	if err != nil {
 		return nil, err
@@ -40,9 +123,10 @@ func decodeAuthToken(authHeader string) (jwt.MapClaims, error) {
 
 	// Check if the token is valid and return the claims.
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		// Validate audience
+		// Validate audience. jwt.audience_case_insensitive accepts issuers
+		// that emit it with different casing.
 		tokenScope := fmt.Sprint(claims["aud"])
-		if tokenScope != ExpectedScope {
+		if tokenScope != ExpectedScope && !(conf.JWT.AudienceCaseInsensitive && strings.EqualFold(tokenScope, ExpectedScope)) {
 			return nil, fmt.Errorf("invalid audience")
 		}
 		return claims, nil
@@ -50,3 +134,19 @@ func decodeAuthToken(authHeader string) (jwt.MapClaims, error) {
 		return nil, fmt.Errorf("invalid token")
 	}
 }
+
+// checkTokenExpiry counts connections made with a token that expires within
+// jwt.near_expiry_threshold, which usually means the client fetches tokens
+// with too short a lifetime and will soon fail to reconnect.
+func checkTokenExpiry(c echo.Context, claims jwt.MapClaims) {
+	threshold := conf.JWT.NearExpiryThreshold
+	exp, ok := claims["exp"].(float64)
+	if threshold <= 0 || !ok {
+		return
+	}
+
+	if remaining := time.Until(time.Unix(int64(exp), 0)); remaining < threshold {
+		TokensNearExpiry.Inc()
+		c.Logger().Debugf("Token expires in %v, ip: %v", remaining.Round(time.Second), c.RealIP())
+	}
+}
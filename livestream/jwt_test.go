@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+)
+
+func signTestToken(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return token
+}
+
+func TestParseAuthToken(t *testing.T) {
+	setConfig(t, "jwt.secret", "secret")
+	setConfig(t, "jwt.secrets", []string{})
+	exp := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name    string
+		issuers []JWTIssuer
+		secret  string
+		claims  jwt.MapClaims
+		wantErr bool
+	}{
+		{
+			name:   "jwt.secret",
+			secret: "secret",
+			claims: jwt.MapClaims{"aud": ExpectedScope, "team_id": 1, "exp": exp},
+		},
+		{
+			name:    "wrong secret",
+			secret:  "other",
+			claims:  jwt.MapClaims{"aud": ExpectedScope, "team_id": 1, "exp": exp},
+			wantErr: true,
+		},
+		{
+			name:    "wrong audience",
+			secret:  "secret",
+			claims:  jwt.MapClaims{"aud": "posthog:other", "team_id": 1, "exp": exp},
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			secret:  "secret",
+			claims:  jwt.MapClaims{"aud": ExpectedScope, "team_id": 1, "exp": time.Now().Add(-time.Hour).Unix()},
+			wantErr: true,
+		},
+		{
+			name:    "issuer's secret",
+			issuers: []JWTIssuer{{Issuer: "eu", Secret: "eu-secret"}},
+			secret:  "eu-secret",
+			claims:  jwt.MapClaims{"aud": ExpectedScope, "iss": "eu", "team_id": 1, "exp": exp},
+		},
+		{
+			name:    "unknown issuer",
+			issuers: []JWTIssuer{{Issuer: "eu", Secret: "eu-secret"}},
+			secret:  "secret",
+			claims:  jwt.MapClaims{"aud": ExpectedScope, "iss": "us", "team_id": 1, "exp": exp},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setJWTIssuers(tt.issuers)
+			t.Cleanup(func() { setJWTIssuers(nil) })
+
+			_, err := parseAuthToken(signTestToken(t, tt.secret, tt.claims))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseAuthToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAudienceCaseInsensitive(t *testing.T) {
+	setConfig(t, "jwt.secret", "secret")
+	setConfig(t, "jwt.secrets", []string{})
+	exp := time.Now().Add(time.Hour).Unix()
+	mixedCase := signTestToken(t, "secret", jwt.MapClaims{"aud": strings.ToUpper(ExpectedScope), "team_id": 1, "exp": exp})
+	other := signTestToken(t, "secret", jwt.MapClaims{"aud": "POSTHOG:OTHER", "team_id": 1, "exp": exp})
+
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		token           string
+		wantErr         bool
+	}{
+		{name: "mixed case, strict by default", token: mixedCase, wantErr: true},
+		{name: "mixed case, case-insensitive", caseInsensitive: true, token: mixedCase},
+		{name: "other audience, case-insensitive", caseInsensitive: true, token: other, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, "jwt.audience_case_insensitive", tt.caseInsensitive)
+			_, err := parseAuthToken(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseAuthToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeAuthFromRequest(t *testing.T) {
+	setConfig(t, "jwt.secret", "secret")
+	setConfig(t, "jwt.cookie_name", "ph_live")
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := signTestToken(t, "secret", jwt.MapClaims{"aud": ExpectedScope, "team_id": 1, "exp": exp})
+	forged := signTestToken(t, "other", jwt.MapClaims{"aud": ExpectedScope, "team_id": 2, "exp": exp})
+
+	tests := []struct {
+		name       string
+		header     string
+		cookie     string
+		cookieName string
+		wantTeam   float64
+		wantErr    bool
+	}{
+		{name: "cookie only", cookie: valid, wantTeam: 1},
+		{name: "header only", header: "Bearer " + valid, wantTeam: 1},
+		{name: "header takes precedence", header: "Bearer " + forged, cookie: valid, wantErr: true},
+		{name: "invalid cookie", cookie: forged, wantErr: true},
+		{name: "other cookie", cookie: valid, cookieName: "session", wantErr: true},
+		{name: "nothing", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/events", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.cookie != "" {
+				name := tt.cookieName
+				if name == "" {
+					name = "ph_live"
+				}
+				req.AddCookie(&http.Cookie{Name: name, Value: tt.cookie})
+			}
+
+			claims, err := decodeAuthFromRequest(echo.New().NewContext(req, httptest.NewRecorder()))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeAuthFromRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && claims["team_id"] != tt.wantTeam {
+				t.Errorf("team_id = %v, want %v", claims["team_id"], tt.wantTeam)
+			}
+		})
+	}
+}
@@ -22,10 +22,92 @@ type PostHogEvent struct {
 	Properties map[string]interface{} `json:"properties"`
 	Timestamp  string                 `json:"timestamp,omitempty"`
 
-	Uuid       string
-	DistinctId string
-	Lat        float64
-	Lng        float64
+	Uuid       string  `json:"uuid,omitempty"`
+	DistinctId string  `json:"distinct_id,omitempty"`
+	Lat        float64 `json:"lat,omitempty"`
+	Lng        float64 `json:"lng,omitempty"`
+
+	// Instance is the node that ingested the event from Kafka. It is set
+	// when the event is shared over pub/sub.
+	Instance string `json:"livestream_instance,omitempty"`
+
+	// Seq is the event's sequence number within its token, assigned by the
+	// filter with replay.sequence_ids enabled. It is local to this process.
+	Seq uint64 `json:"-"`
+
+	// Extra keeps any fields of the upstream payload we don't model so they
+	// survive a decode/encode round trip.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+var knownPostHogEventFields = []string{"api_key", "event", "properties", "timestamp", "uuid", "distinct_id", "lat", "lng", "livestream_instance"}
+
+func (e *PostHogEvent) UnmarshalJSON(data []byte) error {
+	type plain PostHogEvent
+	var event plain
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for _, field := range knownPostHogEventFields {
+		delete(fields, field)
+	}
+	if len(fields) > 0 {
+		event.Extra = fields
+	}
+
+	*e = PostHogEvent(event)
+	return nil
+}
+
+func (e PostHogEvent) MarshalJSON() ([]byte, error) {
+	type plain PostHogEvent
+	data, err := json.Marshal(plain(e))
+	if err != nil || len(e.Extra) == 0 {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for field, value := range e.Extra {
+		if _, ok := fields[field]; !ok {
+			fields[field] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// decodePostHogEvent decodes a message from the events topic: a wrapper whose
+// data field holds the captured event as a JSON string.
+func decodePostHogEvent(message []byte) (PostHogEvent, PostHogEventWrapper, error) {
+	var wrapperMessage PostHogEventWrapper
+	if err := json.Unmarshal(message, &wrapperMessage); err != nil {
+		return PostHogEvent{}, wrapperMessage, err
+	}
+
+	var phEvent PostHogEvent
+	if err := json.Unmarshal([]byte(wrapperMessage.Data), &phEvent); err != nil {
+		return PostHogEvent{}, wrapperMessage, err
+	}
+
+	phEvent.Uuid = wrapperMessage.Uuid
+	phEvent.DistinctId = wrapperMessage.DistinctId
+	if phEvent.Timestamp == "" {
+		phEvent.Timestamp = time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+	if phEvent.Token == "" {
+		if tokenValue, ok := phEvent.Properties["token"].(string); ok {
+			phEvent.Token = tokenValue
+		}
+	}
+
+	return phEvent, wrapperMessage, nil
 }
 
 type KafkaConsumer struct {
@@ -74,33 +156,13 @@ func (c *KafkaConsumer) Consume() {
 			continue
 		}
 
-		var wrapperMessage PostHogEventWrapper
-		err = json.Unmarshal(msg.Value, &wrapperMessage)
-		if err != nil {
-			sentry.CaptureException(err)
-			log.Printf("Error decoding JSON: %v", err)
-			continue
-		}
-
-		var phEvent PostHogEvent
-		err = json.Unmarshal([]byte(wrapperMessage.Data), &phEvent)
+		phEvent, wrapperMessage, err := decodePostHogEvent(msg.Value)
 		if err != nil {
 			sentry.CaptureException(err)
 			log.Printf("Error decoding JSON: %v", err)
 			continue
 		}
 
-		phEvent.Uuid = wrapperMessage.Uuid
-		phEvent.DistinctId = wrapperMessage.DistinctId
-		if phEvent.Timestamp == "" {
-			phEvent.Timestamp = time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
-		}
-		if phEvent.Token == "" {
-			if tokenValue, ok := phEvent.Properties["token"].(string); ok {
-				phEvent.Token = tokenValue
-			}
-		}
-
 		var ipStr string = ""
 		if ipValue, ok := phEvent.Properties["$ip"]; ok {
 			if ipProp, ok := ipValue.(string); ok {
@@ -126,6 +188,6 @@ func (c *KafkaConsumer) Consume() {
 	}
 }
 
-func (c *KafkaConsumer) Close() {
-	c.consumer.Close()
+func (c *KafkaConsumer) Close() error {
+	return c.consumer.Close()
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// A message from the events topic, with fields in the captured event that
+// PostHogEvent doesn't model.
+const upstreamMessage = `{
+	"uuid": "0191c5c6-8d2a-7e3f-9b1a-4c2d3e4f5a6b",
+	"distinct_id": "user-1",
+	"ip": "203.0.113.7",
+	"data": "{\"event\":\"$pageview\",\"properties\":{\"token\":\"phc_test\",\"$current_url\":\"https://example.com/\"},\"timestamp\":\"2024-09-01T12:00:00.000Z\",\"offset\":12,\"$set\":{\"plan\":\"free\"}}"
+}`
+
+func TestDecodePostHogEvent(t *testing.T) {
+	event, wrapper, err := decodePostHogEvent([]byte(upstreamMessage))
+	if err != nil {
+		t.Fatalf("decodePostHogEvent() error: %v", err)
+	}
+
+	if wrapper.Ip != "203.0.113.7" {
+		t.Errorf("wrapper ip = %q, want 203.0.113.7", wrapper.Ip)
+	}
+	want := PostHogEvent{
+		Token:      "phc_test",
+		Event:      "$pageview",
+		Properties: map[string]interface{}{"token": "phc_test", "$current_url": "https://example.com/"},
+		Timestamp:  "2024-09-01T12:00:00.000Z",
+		Uuid:       "0191c5c6-8d2a-7e3f-9b1a-4c2d3e4f5a6b",
+		DistinctId: "user-1",
+		Extra: map[string]json.RawMessage{
+			"offset": json.RawMessage(`12`),
+			"$set":   json.RawMessage(`{"plan":"free"}`),
+		},
+	}
+	if !reflect.DeepEqual(event, want) {
+		t.Errorf("decoded %+v, want %+v", event, want)
+	}
+}
+
+func TestPostHogEventRoundTrip(t *testing.T) {
+	event, _, err := decodePostHogEvent([]byte(upstreamMessage))
+	if err != nil {
+		t.Fatalf("decodePostHogEvent() error: %v", err)
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	for _, field := range []string{"offset", "$set", "event", "uuid", "distinct_id"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("field %q lost in %s", field, data)
+		}
+	}
+
+	var decoded PostHogEvent
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, event) {
+		t.Errorf("round trip gave %+v, want %+v", decoded, event)
+	}
+}
+
+func TestPostHogEventExtraDoesNotOverrideFields(t *testing.T) {
+	event := PostHogEvent{
+		Event: "$pageview",
+		Extra: map[string]json.RawMessage{"event": json.RawMessage(`"spoofed"`)},
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	var decoded PostHogEvent
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if decoded.Event != "$pageview" {
+		t.Errorf("event = %q, want the modeled field to win over Extra", decoded.Event)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lifecycle coordinates shutdown: stop accepting streams, let the open ones
+// finish, and only then tear down what they depend on (the filter, the HTTP
+// server, Kafka and Redis), so nothing is closed while still in use.
+type Lifecycle struct {
+	mu          sync.Mutex
+	draining    atomic.Bool
+	drain       chan struct{}
+	subscribers sync.WaitGroup
+	readyAt     atomic.Int64 // unix nanos before which new streams are refused
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{drain: make(chan struct{})}
+}
+
+// DelayStart refuses new streams for a random time between
+// startup.delay_min and startup.delay_max, so that after a mass restart the
+// nodes don't all take their share of reconnecting clients at once.
+func (l *Lifecycle) DelayStart() {
+	low := conf.Startup.DelayMin
+	high := conf.Startup.DelayMax
+	delay := low
+	if high > low {
+		delay += time.Duration(rand.Int63n(int64(high - low)))
+	}
+	if delay > 0 {
+		log.Printf("Accepting streams in %v", delay.Round(time.Millisecond))
+		l.readyAt.Store(time.Now().Add(delay).UnixNano())
+	}
+}
+
+// Starting reports whether the startup delay is still running, and if so how
+// much of it is left.
+func (l *Lifecycle) Starting() (time.Duration, bool) {
+	remaining := time.Until(time.Unix(0, l.readyAt.Load()))
+	return remaining, remaining > 0
+}
+
+// Draining reports whether shutdown has started.
+func (l *Lifecycle) Draining() bool {
+	return l.draining.Load()
+}
+
+// Drain is closed once shutdown starts; subscribers should end their stream.
+func (l *Lifecycle) Drain() <-chan struct{} {
+	return l.drain
+}
+
+// DrainDelay picks how long a subscriber waits after Drain before closing its
+// stream, spread evenly over shutdown.drain_window so clients don't all
+// reconnect to the remaining nodes at once.
+func (l *Lifecycle) DrainDelay() time.Duration {
+	window := conf.Shutdown.DrainWindow
+	if window <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(window)))
+}
+
+// ReconnectRetry picks the SSE retry value, in milliseconds, sent to a client
+// whose stream is closed by draining. It falls between shutdown.retry_min and
+// shutdown.retry_max, for the same reason as DrainDelay.
+func (l *Lifecycle) ReconnectRetry() string {
+	low := conf.Shutdown.RetryMin
+	high := conf.Shutdown.RetryMax
+	retry := low
+	if high > low {
+		retry += time.Duration(rand.Int63n(int64(high - low)))
+	}
+	return strconv.FormatInt(retry.Milliseconds(), 10)
+}
+
+// Track registers a subscriber. It returns false once draining has started,
+// otherwise the caller must call the returned func when it has exited.
+func (l *Lifecycle) Track() (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.draining.Load() {
+		return nil, false
+	}
+	l.subscribers.Add(1)
+	return l.subscribers.Done, true
+}
+
+// shutdownStageReserve is the share of the shutdown timeout kept back from
+// waiting for subscribers, so the stages after them still get to run.
+const shutdownStageReserve = 4
+
+// Shutdown enters drain mode, waits for every tracked subscriber to exit and
+// then runs stages in order. If ctx has a deadline, waiting for subscribers
+// stops a quarter of the time before it, and each stage is given an equal
+// share of the time left when it starts, so a stage that hangs can't use up
+// the time of the stages after it.
+func (l *Lifecycle) Shutdown(ctx context.Context, stages ...func(context.Context) error) {
+	l.mu.Lock()
+	if !l.draining.Swap(true) {
+		close(l.drain)
+	}
+	l.mu.Unlock()
+
+	exited := make(chan struct{})
+	go func() {
+		l.subscribers.Wait()
+		close(exited)
+	}()
+
+	waitCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithDeadline(ctx, deadline.Add(-time.Until(deadline)/shutdownStageReserve))
+		defer cancel()
+	}
+	select {
+	case <-exited:
+	case <-waitCtx.Done():
+		log.Println("Timed out waiting for subscribers to exit")
+	}
+
+	for i, stage := range stages {
+		if err := runShutdownStage(ctx, stage, len(stages)-i); err != nil {
+			log.Printf("Error during shutdown: %v", err)
+		}
+	}
+}
+
+// runShutdownStage runs stage with its share of the time left before ctx's
+// deadline, split evenly between it and the remaining-1 stages after it.
+func runShutdownStage(ctx context.Context, stage func(context.Context) error, remaining int) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(remaining))
+		defer cancel()
+	}
+	return stage(ctx)
+}
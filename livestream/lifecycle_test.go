@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestShutdownWaitsForSubscribers(t *testing.T) {
+	lifecycle := NewLifecycle()
+
+	var mu sync.Mutex
+	var order []string
+	record := func(step string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, step)
+	}
+
+	// Two subscribers that only exit some time after draining starts.
+	var started sync.WaitGroup
+	for i, name := range []string{"first subscriber", "second subscriber"} {
+		exited, ok := lifecycle.Track()
+		if !ok {
+			t.Fatal("Track() refused a subscriber before shutdown")
+		}
+		started.Add(1)
+		go func(name string, delay time.Duration) {
+			defer exited()
+			started.Done()
+			<-lifecycle.Drain()
+			time.Sleep(delay)
+			record(name + " exited")
+		}(name, time.Duration(i+1)*10*time.Millisecond)
+	}
+	started.Wait()
+
+	stage := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			record(name)
+			return nil
+		}
+	}
+	lifecycle.Shutdown(context.Background(), stage("filter stopped"), stage("redis closed"))
+
+	want := []string{"filter stopped", "redis closed"}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 4 || !slices.Equal(order[2:], want) {
+		t.Errorf("shutdown ran %v, want both subscribers to exit before %v", order, want)
+	}
+
+	if _, ok := lifecycle.Track(); ok {
+		t.Error("Track() accepted a subscriber after shutdown started")
+	}
+}
+
+func TestShutdownGivesUpOnStuckSubscribers(t *testing.T) {
+	lifecycle := NewLifecycle()
+	if _, ok := lifecycle.Track(); !ok {
+		t.Fatal("Track() refused a subscriber before shutdown")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	closed := false
+	lifecycle.Shutdown(ctx, func(context.Context) error {
+		closed = true
+		return nil
+	})
+	if !closed {
+		t.Error("shutdown stages didn't run after the timeout")
+	}
+}
+
+func TestShutdownReservesTimeForStages(t *testing.T) {
+	lifecycle := NewLifecycle()
+	if _, ok := lifecycle.Track(); !ok {
+		t.Fatal("Track() refused a subscriber before shutdown")
+	}
+
+	// A stuck subscriber and a stage that hangs until its context is done
+	// must leave time for the stages after them.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var timeLeft []time.Duration
+	record := func(stageCtx context.Context) {
+		deadline, _ := stageCtx.Deadline()
+		timeLeft = append(timeLeft, time.Until(deadline))
+	}
+	lifecycle.Shutdown(ctx,
+		func(stageCtx context.Context) error {
+			record(stageCtx)
+			<-stageCtx.Done()
+			return stageCtx.Err()
+		},
+		func(stageCtx context.Context) error {
+			record(stageCtx)
+			return nil
+		},
+	)
+
+	if len(timeLeft) != 2 {
+		t.Fatalf("ran %d stages, want 2", len(timeLeft))
+	}
+	for i, left := range timeLeft {
+		if left < 10*time.Millisecond {
+			t.Errorf("stage %d started with %v left, want time reserved for it", i, left)
+		}
+	}
+	if ctx.Err() != nil {
+		t.Error("shutdown used up the whole timeout")
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	setConfig(t, "startup.delay_min", 50*time.Millisecond)
+	setConfig(t, "startup.delay_max", 50*time.Millisecond)
+	lifecycle := NewLifecycle()
+	lifecycle.DelayStart()
+
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent))
+	subscribed := make(subscriptionNotifier, 1)
+	filter.SetObserver(subscribed)
+	go filter.Run()
+	defer filter.Stop()
+
+	health := HealthHandler(lifecycle)
+	stream := StreamEventsHandler(filter, lifecycle, NewAckRegistry(), NewSubscriptionControls())
+	newContext := func(ctx context.Context, target string) (echo.Context, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx)
+		return echo.New().NewContext(req, rec), rec
+	}
+
+	c, rec := newContext(context.Background(), "/health")
+	if err := health(c); err != nil || rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("health during the delay got %d, %v, want 503", rec.Code, err)
+	}
+	c, rec = newContext(context.Background(), "/events?geo=true")
+	var httpErr *echo.HTTPError
+	if err := stream(c); !errors.As(err, &httpErr) || httpErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("stream during the delay got %v, want 503", err)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want the delay rounded up to 1s", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	c, rec = newContext(context.Background(), "/health")
+	if err := health(c); err != nil || rec.Code != http.StatusOK {
+		t.Errorf("health after the delay got %d, %v, want 200", rec.Code, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c, _ = newContext(ctx, "/events?geo=true")
+	done := make(chan error, 1)
+	go func() { done <- stream(c) }()
+	select {
+	case <-subscribed:
+	case err := <-done:
+		t.Fatalf("stream after the delay returned %v instead of subscribing", err)
+	case <-time.After(time.Second):
+		t.Fatal("stream after the delay didn't subscribe")
+	}
+	cancel()
+	<-done
+}
+
+func TestDrainSpreadsReconnects(t *testing.T) {
+	const window = 400 * time.Millisecond
+	setConfig(t, "shutdown.drain_window", window)
+	setConfig(t, "shutdown.retry_min", time.Second)
+	setConfig(t, "shutdown.retry_max", 5*time.Second)
+
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent))
+	subscribed := make(subscriptionNotifier, 1)
+	filter.SetObserver(subscribed)
+	go filter.Run()
+	t.Cleanup(filter.Stop)
+	lifecycle := NewLifecycle()
+	handler := StreamEventsHandler(filter, lifecycle, NewAckRegistry(), NewSubscriptionControls())
+
+	const streams = 10
+	closed := make(chan time.Time, streams)
+	recorders := make([]*flushRecorder, streams)
+	for i := range recorders {
+		recorders[i] = &flushRecorder{header: make(http.Header)}
+		req := httptest.NewRequest(http.MethodGet, "/events?geo=true", nil)
+		go func(rec *flushRecorder) {
+			handler(echo.New().NewContext(req, rec))
+			closed <- time.Now()
+		}(recorders[i])
+		select {
+		case <-subscribed:
+		case <-time.After(time.Second):
+			t.Fatal("stream didn't subscribe")
+		}
+	}
+
+	start := time.Now()
+	go lifecycle.Shutdown(context.Background())
+	var delays []time.Duration
+	for i := 0; i < streams; i++ {
+		select {
+		case at := <-closed:
+			delays = append(delays, at.Sub(start))
+		case <-time.After(2 * window):
+			t.Fatalf("only %d of %d streams closed within the drain window", i, streams)
+		}
+	}
+
+	// Ten delays drawn from the window landing within a quarter of it of
+	// each other is vanishingly unlikely unless they all close at once.
+	if spread := slices.Max(delays) - slices.Min(delays); spread < window/4 {
+		t.Errorf("streams closed within %v of each other, want them spread over %v", spread, window)
+	}
+
+	retries := map[string]bool{}
+	for _, rec := range recorders {
+		rec.mu.Lock()
+		body := rec.body.String()
+		rec.mu.Unlock()
+		i := strings.Index(body, "retry: ")
+		if i < 0 {
+			t.Fatalf("drained stream wasn't sent a retry: %q", body)
+		}
+		retry := strings.Fields(body[i+len("retry: "):])[0]
+		ms, err := strconv.Atoi(retry)
+		if err != nil || ms < 1000 || ms >= 5000 {
+			t.Errorf("retry: %s, want between 1000 and 5000", retry)
+		}
+		retries[retry] = true
+	}
+	if len(retries) < 2 {
+		t.Errorf("every drained stream was sent retry: %v, want them randomized", retries)
+	}
+}
@@ -2,25 +2,466 @@ package main
 
 import (
 	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/golang-lru/v2/expirable"
 )
 
 type TeamStats struct {
-	Store map[string]*expirable.LRU[string, string]
+	// TTL is how long a user (or event) counts towards the live stats.
+	TTL time.Duration
+	// TokenTTLs overrides TTL for specific tokens.
+	TokenTTLs map[string]time.Duration
+	// MaxEventNames caps how many entries a token's breakdown has, the
+	// otherEventName entry included.
+	MaxEventNames int
+	// TrimDistinctIDs and LowercaseDistinctIDs normalize distinct IDs before
+	// they are counted, so the same user sent with stray whitespace or
+	// different casing is only counted once.
+	TrimDistinctIDs      bool
+	LowercaseDistinctIDs bool
+	// GracePeriod, when set, only counts a distinct ID once it has been seen
+	// twice within that long. Until then it waits in Pending, which keeps
+	// single-hit visitors such as bots out of the live user count.
+	GracePeriod time.Duration
+	// TokenGroups maps each token in a stats.token_groups entry to every
+	// token in its group, for counting users across related projects.
+	TokenGroups map[string][]string
+	// MaxPropertyKeys, when positive, samples which property keys each
+	// token's events carry, keeping counts for up to that many keys.
+	MaxPropertyKeys int
+	// PeakWindow is how long a token's peak user count is kept before it
+	// starts over from the current count.
+	PeakWindow time.Duration
+
+	mu      sync.RWMutex
+	Store   map[string]*expirable.LRU[string, string]
+	Pending map[string]*expirable.LRU[string, struct{}]
+	// Groups holds the live users of each token group, keyed by its first
+	// token, so a group's count doesn't have to be worked out per request.
+	Groups     map[string]*expirable.LRU[string, struct{}]
+	Peaks      map[string]*userPeak
+	Events     map[string]*eventCounter
+	Breakdowns map[string]map[string]*eventCounter
+	Properties map[string]map[string]*eventCounter
 }
 
+// otherEventName collects events whose name didn't fit in a token's breakdown.
+const otherEventName = "__other__"
+
+// Snapshot returns the number of live users per token. The returned map is a
+// copy and can be modified freely.
+func (ts *TeamStats) Snapshot() map[string]int {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	snapshot := make(map[string]int, len(ts.Store))
+	for token, users := range ts.Store {
+		snapshot[token] = users.Len()
+	}
+	return snapshot
+}
+
+// statsPruneInterval is how often the stats keeper forgets quiet tokens.
+const statsPruneInterval = time.Minute
+
 func (ts *TeamStats) keepStats(statsChan chan PostHogEvent) {
 	log.Println("starting stats keeper...")
-	for { // ignore the range warning here - it's wrong
+	prune := time.NewTicker(statsPruneInterval)
+	defer prune.Stop()
+	for {
 		select {
 		case event := <-statsChan:
-			token := event.Token
-			if _, ok := ts.Store[token]; !ok {
-				ts.Store[token] = expirable.NewLRU[string, string](1000000, nil, time.Second*30)
+			ts.add(event)
+		case now := <-prune.C:
+			ts.prune(now)
+		}
+	}
+}
+
+func (ts *TeamStats) add(event PostHogEvent) {
+	token := event.Token
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if _, ok := ts.Store[token]; !ok {
+		ts.Store[token] = expirable.NewLRU[string, string](1000000, nil, ts.ttlFor(token))
+	}
+	if distinctId := ts.normalizeDistinctId(event.DistinctId); ts.countable(token, distinctId) {
+		ts.Store[token].Add(distinctId, "much wow")
+		ts.recordPeak(token, ts.Store[token].Len(), time.Now())
+		ts.addToGroup(token, distinctId)
+	}
+
+	if _, ok := ts.Events[token]; !ok {
+		ts.Events[token] = newEventCounter(ts.ttlFor(token))
+	}
+	ts.Events[token].add(time.Now())
+	ts.addToBreakdown(token, event.Event, time.Now())
+	if ts.MaxPropertyKeys > 0 {
+		ts.addPropertyKeys(token, event.Properties, time.Now())
+	}
+}
+
+// configuredStatsTTL returns stats.ttl, clamped to stats.max_ttl so a
+// misconfigured window can't make the stats keeper hold on to users forever.
+func configuredStatsTTL() time.Duration {
+	ttl := conf.Stats.TTL
+	maxTTL := conf.Stats.MaxTTL
+	if maxTTL > 0 && ttl > maxTTL {
+		log.Printf("stats.ttl of %v is above stats.max_ttl, using %v", ttl, maxTTL)
+		return maxTTL
+	}
+	return ttl
+}
+
+// userPeak is the highest user count seen for a token since start.
+type userPeak struct {
+	users int
+	start time.Time
+}
+
+// recordPeak raises the token's peak to users if higher, starting a new peak
+// once the current one is older than PeakWindow. Callers must hold ts.mu.
+func (ts *TeamStats) recordPeak(token string, users int, now time.Time) {
+	peak, ok := ts.Peaks[token]
+	if !ok || now.Sub(peak.start) >= ts.PeakWindow {
+		ts.Peaks[token] = &userPeak{users: users, start: now}
+		return
+	}
+	if users > peak.users {
+		peak.users = users
+	}
+}
+
+// countable reports whether distinctId should be added to the token's users:
+// always without a grace period, otherwise only when it is already counted or
+// is seen again within GracePeriod. Callers must hold ts.mu.
+func (ts *TeamStats) countable(token string, distinctId string) bool {
+	if ts.GracePeriod <= 0 || ts.Store[token].Contains(distinctId) {
+		return true
+	}
+
+	pending, ok := ts.Pending[token]
+	if !ok {
+		pending = expirable.NewLRU[string, struct{}](1000000, nil, ts.GracePeriod)
+		ts.Pending[token] = pending
+	}
+	// Peek, unlike Contains, ignores entries that expired but haven't been
+	// purged yet, so a second hit after GracePeriod starts over.
+	if _, ok := pending.Peek(distinctId); ok {
+		pending.Remove(distinctId)
+		return true
+	}
+	pending.Add(distinctId, struct{}{})
+	return false
+}
+
+func (ts *TeamStats) normalizeDistinctId(distinctId string) string {
+	if ts.TrimDistinctIDs {
+		distinctId = strings.TrimSpace(distinctId)
+	}
+	if ts.LowercaseDistinctIDs {
+		distinctId = strings.ToLower(distinctId)
+	}
+	return distinctId
+}
+
+// reportActiveTokens sets ActiveTokens to the number of tokens with live
+// users every interval. Tokens stay in Store after their users expire, so
+// it's the size of each LRU that counts.
+func (ts *TeamStats) reportActiveTokens(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ActiveTokens.Set(float64(ts.activeTokens()))
+	}
+}
+
+func (ts *TeamStats) activeTokens() int {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	active := 0
+	for _, users := range ts.Store {
+		if users.Len() > 0 {
+			active++
+		}
+	}
+	return active
+}
+
+// addToBreakdown counts an event under its name. One entry is kept back for
+// otherEventName: once a token has MaxEventNames-1 names, names that have gone
+// quiet make room for new ones and anything else is counted under
+// otherEventName. Callers must hold ts.mu.
+func (ts *TeamStats) addToBreakdown(token string, name string, now time.Time) {
+	breakdown, ok := ts.Breakdowns[token]
+	if !ok {
+		breakdown = make(map[string]*eventCounter)
+		ts.Breakdowns[token] = breakdown
+	}
+
+	if _, ok := breakdown[name]; !ok && namedEvents(breakdown) >= ts.MaxEventNames-1 {
+		for existing, counter := range breakdown {
+			if existing != otherEventName && counter.count(now) == 0 {
+				delete(breakdown, existing)
 			}
-			ts.Store[token].Add(event.DistinctId, "much wow")
+		}
+		if namedEvents(breakdown) >= ts.MaxEventNames-1 {
+			name = otherEventName
+		}
+	}
+
+	if _, ok := breakdown[name]; !ok {
+		breakdown[name] = newEventCounter(ts.ttlFor(token))
+	}
+	breakdown[name].add(now)
+}
+
+// namedEvents returns how many entries of a breakdown are event names rather
+// than otherEventName.
+func namedEvents(breakdown map[string]*eventCounter) int {
+	if _, ok := breakdown[otherEventName]; ok {
+		return len(breakdown) - 1
+	}
+	return len(breakdown)
+}
+
+// prune forgets the counters of tokens that have had no events within their
+// stats window, and their peak once it is over and no users are left, so a
+// token that goes quiet doesn't hold memory forever. Store keeps its entry:
+// its users expire on their own, and dropping the LRU would leak its cleanup
+// goroutine.
+func (ts *TeamStats) prune(now time.Time) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for token, counter := range ts.Events {
+		if counter.count(now) == 0 {
+			delete(ts.Events, token)
+		}
+	}
+	for token, breakdown := range ts.Breakdowns {
+		if quiet(breakdown, now) {
+			delete(ts.Breakdowns, token)
+		}
+	}
+	for token, keys := range ts.Properties {
+		if quiet(keys, now) {
+			delete(ts.Properties, token)
+		}
+	}
+	for token, peak := range ts.Peaks {
+		users, ok := ts.Store[token]
+		if now.Sub(peak.start) >= ts.PeakWindow && (!ok || users.Len() == 0) {
+			delete(ts.Peaks, token)
 		}
 	}
 }
+
+// quiet reports whether none of counters has counted an event within its
+// window.
+func quiet(counters map[string]*eventCounter, now time.Time) bool {
+	for _, counter := range counters {
+		if counter.count(now) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// addPropertyKeys counts the top level property keys of an event. Once a
+// token has MaxPropertyKeys keys, keys that have gone quiet make room for new
+// ones and anything else isn't counted. Callers must hold ts.mu.
+func (ts *TeamStats) addPropertyKeys(token string, properties map[string]interface{}, now time.Time) {
+	keys, ok := ts.Properties[token]
+	if !ok {
+		keys = make(map[string]*eventCounter)
+		ts.Properties[token] = keys
+	}
+
+	for key := range properties {
+		if _, ok := keys[key]; !ok && len(keys) >= ts.MaxPropertyKeys {
+			for existing, counter := range keys {
+				if counter.count(now) == 0 {
+					delete(keys, existing)
+				}
+			}
+			if len(keys) >= ts.MaxPropertyKeys {
+				continue
+			}
+		}
+		if _, ok := keys[key]; !ok {
+			keys[key] = newEventCounter(ts.ttlFor(token))
+		}
+		keys[key].add(now)
+	}
+}
+
+// topPropertyKeys returns up to limit of the token's most common property
+// keys over the stats window, most common first. Callers must hold ts.mu for
+// reading.
+func (ts *TeamStats) topPropertyKeys(token string, limit int, now time.Time) []PropertyKeyCount {
+	var counts []PropertyKeyCount
+	for key, counter := range ts.Properties[token] {
+		if count := counter.count(now); count > 0 {
+			counts = append(counts, PropertyKeyCount{Key: key, Count: count})
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	if len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
+
+// breakdown returns the event counts per name for token. Callers must hold
+// ts.mu for reading.
+func (ts *TeamStats) breakdown(token string, now time.Time) map[string]int {
+	counts := make(map[string]int)
+	for name, counter := range ts.Breakdowns[token] {
+		if count := counter.count(now); count > 0 {
+			counts[name] = count
+		}
+	}
+	return counts
+}
+
+func (ts *TeamStats) ttlFor(token string) time.Duration {
+	if ttl, ok := ts.TokenTTLs[token]; ok {
+		return ttl
+	}
+	return ts.TTL
+}
+
+// configuredTokenTTLs returns the stats.token_ttls overrides, e.g. to give a
+// large customer a longer live users window. It's a list of {token, ttl}
+// entries rather than a map because viper lowercases map keys. Overrides are
+// clamped like stats.ttl.
+func configuredTokenTTLs() map[string]time.Duration {
+	maxTTL := conf.Stats.MaxTTL
+	ttls := make(map[string]time.Duration, len(conf.Stats.TokenTTLs))
+	for _, override := range conf.Stats.TokenTTLs {
+		ttl := override.TTL
+		if override.Token == "" || ttl <= 0 {
+			continue
+		}
+		if maxTTL > 0 && ttl > maxTTL {
+			log.Printf("stats.token_ttls for token %s of %v is above stats.max_ttl, using %v", override.Token, ttl, maxTTL)
+			ttl = maxTTL
+		}
+		ttls[override.Token] = ttl
+	}
+	return ttls
+}
+
+// addToGroup counts distinctId as live in token's group, if it has one. A
+// user stays in the group for the longest TTL of its tokens. Callers must
+// hold ts.mu.
+func (ts *TeamStats) addToGroup(token string, distinctId string) {
+	group, ok := ts.TokenGroups[token]
+	if !ok {
+		return
+	}
+
+	users, ok := ts.Groups[group[0]]
+	if !ok {
+		var ttl time.Duration
+		for _, member := range group {
+			ttl = max(ttl, ts.ttlFor(member))
+		}
+		users = expirable.NewLRU[string, struct{}](1000000, nil, ttl)
+		ts.Groups[group[0]] = users
+	}
+	users.Add(distinctId, struct{}{})
+}
+
+// groupUsers returns the number of distinct users live across token's group,
+// counting a distinct ID seen under several tokens once. Tokens outside any
+// group count their own users. Callers must hold ts.mu for reading.
+func (ts *TeamStats) groupUsers(token string) int {
+	if group, ok := ts.TokenGroups[token]; ok {
+		if users, ok := ts.Groups[group[0]]; ok {
+			return users.Len()
+		}
+		return 0
+	}
+	if users, ok := ts.Store[token]; ok {
+		return users.Len()
+	}
+	return 0
+}
+
+// configuredTokenGroups returns stats.token_groups by member token. Each
+// entry lists tokens whose users are the same people, e.g. an app's staging
+// and production projects.
+func configuredTokenGroups() map[string][]string {
+	groups := make(map[string][]string)
+	for _, entry := range conf.Stats.TokenGroups {
+		for _, token := range entry.Tokens {
+			groups[token] = entry.Tokens
+		}
+	}
+	return groups
+}
+
+// eventCounter counts events over a sliding window. The window is split into
+// eventCounterBuckets buckets, so a counter takes the same memory whatever its
+// window, and old events drop out one bucket, a sixtieth of the window, at a
+// time.
+type eventCounter struct {
+	width   time.Duration
+	buckets [eventCounterBuckets]eventBucket
+}
+
+const eventCounterBuckets = 60
+
+type eventBucket struct {
+	slot  int64
+	count int
+}
+
+func newEventCounter(window time.Duration) *eventCounter {
+	return &eventCounter{width: max(window/eventCounterBuckets, 1)}
+}
+
+func (ec *eventCounter) slot(now time.Time) int64 {
+	return now.UnixNano() / int64(ec.width)
+}
+
+func (ec *eventCounter) add(now time.Time) {
+	slot := ec.slot(now)
+	bucket := &ec.buckets[slot%eventCounterBuckets]
+	if bucket.slot != slot {
+		bucket.slot = slot
+		bucket.count = 0
+	}
+	bucket.count++
+}
+
+func (ec *eventCounter) count(now time.Time) int {
+	cutoff := ec.slot(now) - eventCounterBuckets
+	total := 0
+	for _, bucket := range ec.buckets {
+		if bucket.slot > cutoff {
+			total += bucket.count
+		}
+	}
+	return total
+}
+
+// perMinute returns the rate of events over the counter's window, scaled to a
+// minute. A 30s window holding 10 events is a rate of 20 per minute.
+func (ec *eventCounter) perMinute(now time.Time) float64 {
+	window := ec.width * eventCounterBuckets
+	return float64(ec.count(now)) / window.Minutes()
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEventCounter(t *testing.T) {
+	start := time.Date(2024, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		window        time.Duration
+		events        []time.Duration // since start
+		at            time.Duration
+		wantCount     int
+		wantPerMinute float64
+	}{
+		{
+			name:          "all within the window",
+			window:        time.Minute,
+			events:        []time.Duration{0, 10 * time.Second, 59 * time.Second},
+			at:            59 * time.Second,
+			wantCount:     3,
+			wantPerMinute: 3,
+		},
+		{
+			name:          "older events drop out",
+			window:        time.Minute,
+			events:        []time.Duration{0, 31 * time.Second, 90 * time.Second},
+			at:            90 * time.Second,
+			wantCount:     2,
+			wantPerMinute: 2,
+		},
+		{
+			name:          "rate is scaled to a minute",
+			window:        30 * time.Second,
+			events:        []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second},
+			at:            3 * time.Second,
+			wantCount:     4,
+			wantPerMinute: 8,
+		},
+		{
+			name:          "long windows use coarse buckets",
+			window:        24 * time.Hour,
+			events:        []time.Duration{0, time.Hour, 23 * time.Hour},
+			at:            24*time.Hour + 23*time.Minute,
+			wantCount:     2,
+			wantPerMinute: 2.0 / (24 * 60),
+		},
+		{
+			name:          "nothing once the window has passed",
+			window:        time.Minute,
+			events:        []time.Duration{0, time.Second},
+			at:            10 * time.Minute,
+			wantCount:     0,
+			wantPerMinute: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := newEventCounter(tt.window)
+			for _, offset := range tt.events {
+				counter.add(start.Add(offset))
+			}
+
+			now := start.Add(tt.at)
+			if got := counter.count(now); got != tt.wantCount {
+				t.Errorf("count() = %d, want %d", got, tt.wantCount)
+			}
+			if got := counter.perMinute(now); got != tt.wantPerMinute {
+				t.Errorf("perMinute() = %v, want %v", got, tt.wantPerMinute)
+			}
+		})
+	}
+}
+
+func newTestTeamStats() *TeamStats {
+	return &TeamStats{
+		TTL:           time.Minute,
+		MaxEventNames: 10,
+		PeakWindow:    time.Hour,
+		Store:         make(map[string]*expirable.LRU[string, string]),
+		Pending:       make(map[string]*expirable.LRU[string, struct{}]),
+		Groups:        make(map[string]*expirable.LRU[string, struct{}]),
+		Peaks:         make(map[string]*userPeak),
+		Events:        make(map[string]*eventCounter),
+		Breakdowns:    make(map[string]map[string]*eventCounter),
+		Properties:    make(map[string]map[string]*eventCounter),
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ts := newTestTeamStats()
+	for _, event := range []PostHogEvent{
+		{Token: "a", DistinctId: "alice"},
+		{Token: "a", DistinctId: "bob"},
+		{Token: "a", DistinctId: "alice"},
+		{Token: "b", DistinctId: "carol"},
+	} {
+		ts.add(event)
+	}
+
+	snapshot := ts.Snapshot()
+	if want := map[string]int{"a": 2, "b": 1}; !maps.Equal(snapshot, want) {
+		t.Errorf("Snapshot() = %v, want %v", snapshot, want)
+	}
+
+	snapshot["a"] = 100
+	delete(snapshot, "b")
+	if got := ts.Snapshot(); got["a"] != 2 || got["b"] != 1 {
+		t.Errorf("changing a snapshot changed the stats to %v", got)
+	}
+}
+
+func TestGroupUsers(t *testing.T) {
+	ts := newTestTeamStats()
+	group := []string{"staging", "production"}
+	ts.TokenGroups = map[string][]string{"staging": group, "production": group}
+
+	for _, event := range []PostHogEvent{
+		{Token: "staging", DistinctId: "alice"},
+		{Token: "production", DistinctId: "alice"},
+		{Token: "production", DistinctId: "bob"},
+		{Token: "other", DistinctId: "alice"},
+		{Token: "other", DistinctId: "carol"},
+	} {
+		ts.add(event)
+	}
+
+	for token, want := range map[string]int{
+		"staging":    2,
+		"production": 2,
+		"other":      2,
+		"unknown":    0,
+	} {
+		if got := ts.groupUsers(token); got != want {
+			t.Errorf("groupUsers(%q) = %d, want %d", token, got, want)
+		}
+	}
+}
+
+func TestBreakdown(t *testing.T) {
+	start := time.Now()
+	ttl := time.Minute
+
+	tests := []struct {
+		name   string
+		events []string
+		after  time.Duration // before the last event
+		want   map[string]int
+	}{
+		{
+			name:   "within the cap",
+			events: []string{"a", "b", "a"},
+			want:   map[string]int{"a": 2, "b": 1},
+		},
+		{
+			name:   "names over the cap roll up into other",
+			events: []string{"a", "b", "c", "d", "a", "c"},
+			want:   map[string]int{"a": 2, "b": 1, otherEventName: 3},
+		},
+		{
+			name:   "quiet names make room",
+			events: []string{"a", "b", "c"},
+			after:  2 * ttl,
+			want:   map[string]int{"c": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestTeamStats()
+			ts.TTL = ttl
+			ts.MaxEventNames = 3
+
+			now := start
+			for i, name := range tt.events {
+				if i == len(tt.events)-1 {
+					now = now.Add(tt.after)
+				}
+				ts.addToBreakdown("token", name, now)
+				if got := len(ts.Breakdowns["token"]); got > ts.MaxEventNames {
+					t.Fatalf("breakdown grew to %d entries, over the cap of %d", got, ts.MaxEventNames)
+				}
+			}
+
+			if got := ts.breakdown("token", now); !maps.Equal(got, tt.want) {
+				t.Errorf("breakdown = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPruneForgetsQuietTokens(t *testing.T) {
+	ts := newTestTeamStats()
+	ts.MaxPropertyKeys = 10
+	now := time.Now()
+
+	record := func(token string, at time.Time) {
+		ts.Events[token] = newEventCounter(ts.TTL)
+		ts.Events[token].add(at)
+		ts.addToBreakdown(token, "$pageview", at)
+		ts.addPropertyKeys(token, map[string]interface{}{"$browser": "Firefox"}, at)
+		ts.recordPeak(token, 1, at.Add(-ts.PeakWindow))
+	}
+	record("quiet", now.Add(-2*ts.TTL))
+	record("busy", now)
+	// A peak outlives the token's counters while it still has live users.
+	ts.Store["quiet"] = expirable.NewLRU[string, string](10, nil, time.Hour)
+	ts.Store["quiet"].Add("alice", "")
+
+	ts.prune(now)
+
+	for name, pruned := range map[string]bool{
+		"Events":     ts.Events["quiet"] == nil && ts.Events["busy"] != nil,
+		"Breakdowns": ts.Breakdowns["quiet"] == nil && ts.Breakdowns["busy"] != nil,
+		"Properties": ts.Properties["quiet"] == nil && ts.Properties["busy"] != nil,
+		// Of the two, only "quiet" has live users.
+		"Peaks": ts.Peaks["quiet"] != nil && ts.Peaks["busy"] == nil,
+	} {
+		if !pruned {
+			t.Errorf("%s wasn't pruned to the tokens still in use", name)
+		}
+	}
+
+	ts.Store["quiet"].Remove("alice")
+	ts.prune(now)
+	if _, ok := ts.Peaks["quiet"]; ok {
+		t.Error("kept the peak of a token with no users after its window")
+	}
+}
+
+func TestConfiguredStatsTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		ttl    time.Duration
+		maxTTL time.Duration
+		want   time.Duration
+	}{
+		{name: "within the cap", ttl: time.Minute, maxTTL: time.Hour, want: time.Minute},
+		{name: "above the cap", ttl: 48 * time.Hour, maxTTL: 24 * time.Hour, want: 24 * time.Hour},
+		{name: "no cap", ttl: 48 * time.Hour, want: 48 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, "stats.ttl", tt.ttl)
+			setConfig(t, "stats.max_ttl", tt.maxTTL)
+			if got := configuredStatsTTL(); got != tt.want {
+				t.Errorf("configuredStatsTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenTTLOverrides(t *testing.T) {
+	ts := newTestTeamStats()
+	ts.TTL = 50 * time.Millisecond
+	ts.TokenTTLs = map[string]time.Duration{"enterprise": time.Hour}
+	for _, token := range []string{"default", "enterprise"} {
+		ts.add(PostHogEvent{Token: token, DistinctId: "alice"})
+	}
+
+	// Expired users are purged up to a window after they expire.
+	time.Sleep(3 * ts.TTL)
+	if got, want := ts.Snapshot(), map[string]int{"default": 0, "enterprise": 1}; !maps.Equal(got, want) {
+		t.Errorf("live users = %v, want only the overridden token's user still live", got)
+	}
+	now := time.Now()
+	if got := ts.Events["default"].count(now); got != 0 {
+		t.Errorf("default token counts %d events, want its window to have passed", got)
+	}
+	if got := ts.Events["enterprise"].count(now); got != 1 {
+		t.Errorf("enterprise token counts %d events, want 1 within its longer window", got)
+	}
+}
+
+func TestConfiguredTokenTTLs(t *testing.T) {
+	setConfig(t, "stats.max_ttl", 24*time.Hour)
+	setConfig(t, "stats.token_ttls", []map[string]interface{}{
+		{"token": "enterprise", "ttl": "1h"},
+		{"token": "greedy", "ttl": "720h"},
+	})
+
+	want := map[string]time.Duration{"enterprise": time.Hour, "greedy": 24 * time.Hour}
+	if got := configuredTokenTTLs(); !maps.Equal(got, want) {
+		t.Errorf("configuredTokenTTLs() = %v, want %v", got, want)
+	}
+}
+
+func TestNormalizeDistinctIDs(t *testing.T) {
+	tests := []struct {
+		name      string
+		trim      bool
+		lowercase bool
+		want      int
+	}{
+		{name: "off", want: 4},
+		{name: "trim", trim: true, want: 3},
+		{name: "lowercase", lowercase: true, want: 3},
+		{name: "trim and lowercase", trim: true, lowercase: true, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestTeamStats()
+			ts.TrimDistinctIDs = tt.trim
+			ts.LowercaseDistinctIDs = tt.lowercase
+			for _, distinctId := range []string{"alice", "Alice", " alice", "ALICE\t"} {
+				ts.add(PostHogEvent{Token: "token", DistinctId: distinctId, Event: "$pageview"})
+			}
+			if got := ts.Snapshot()["token"]; got != tt.want {
+				t.Errorf("counted %d users, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportActiveTokens(t *testing.T) {
+	ts := newTestTeamStats()
+	ts.TokenTTLs = map[string]time.Duration{"brief": 20 * time.Millisecond}
+	for _, token := range []string{"first", "second", "brief"} {
+		ts.add(PostHogEvent{Token: token, DistinctId: "alice", Event: "$pageview"})
+	}
+	go ts.reportActiveTokens(5 * time.Millisecond)
+
+	active := func(want float64) func() bool {
+		return func() bool { return testutil.ToFloat64(ActiveTokens) == want }
+	}
+	waitFor(t, "3 active tokens", active(3))
+	// brief's users expire, but the token stays in Store.
+	waitFor(t, "brief to stop counting as active", active(2))
+	if _, ok := ts.Store["brief"]; !ok {
+		t.Error("brief was removed from Store, want it to only stop counting once its users expire")
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	const grace = 20 * time.Millisecond
+	ts := newTestTeamStats()
+	ts.GracePeriod = grace
+	add := func(distinctId string) {
+		ts.add(PostHogEvent{Token: "token", DistinctId: distinctId, Event: "$pageview"})
+	}
+
+	add("bot")
+	add("alice")
+	add("alice")
+	if got := ts.Snapshot()["token"]; got != 1 {
+		t.Errorf("counted %d users, want only the repeat visitor", got)
+	}
+
+	// A second hit after the grace period is a first hit again.
+	add("carol")
+	time.Sleep(2 * grace)
+	add("carol")
+	if got := ts.Snapshot()["token"]; got != 1 {
+		t.Errorf("counted %d users, want hits further apart than the grace period not to count", got)
+	}
+	add("carol")
+	if got := ts.Snapshot()["token"]; got != 2 {
+		t.Errorf("counted %d users, want carol counted once seen twice within the grace period", got)
+	}
+}
@@ -1,29 +1,40 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
-	"sync/atomic"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"github.com/spf13/viper"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 )
 
 func main() {
 	loadConfigs()
 
-	isProd := viper.GetBool("prod")
+	config, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf = *config
+	registerMetrics(prometheus.DefaultRegisterer, config.Metrics.Namespace)
+	setAPITokenPattern(config.Auth.TokenPattern)
+	setJWTIssuers(config.JWT.Issuers)
+
+	isProd := config.Prod
 
-	err := sentry.Init(sentry.ClientOptions{
-		Dsn:              viper.GetString("sentry.dsn"),
+	err = sentry.Init(sentry.ClientOptions{
+		Dsn:              config.Sentry.DSN,
 		Debug:            isProd,
 		AttachStacktrace: true,
 	})
@@ -35,35 +46,29 @@ func main() {
 	// Set the timeout to the maximum duration the program can afford to wait.
 	defer sentry.Flush(2 * time.Second)
 
-	mmdb := viper.GetString("mmdb.path")
-	if mmdb == "" {
-		sentry.CaptureException(errors.New("mmdb.path must be set"))
-		log.Fatal("mmdb.path must be set")
-	}
-	brokers := viper.GetString("kafka.brokers")
-	if brokers == "" {
-		sentry.CaptureException(errors.New("kafka.brokers must be set"))
-		log.Fatal("kafka.brokers must be set")
-	}
-	topic := viper.GetString("kafka.topic")
-	if topic == "" {
-		sentry.CaptureException(errors.New("kafka.topic must be set"))
-		log.Fatal("kafka.topic must be set")
-	}
-	groupID := viper.GetString("kafka.group_id")
-	if groupID == "" {
-		sentry.CaptureException(errors.New("kafka.group_id must be set"))
-		log.Fatal("kafka.group_id must be set")
-	}
-
-	geolocator, err := NewGeoLocator(mmdb)
+	geolocator, err := NewGeoLocator(config.MMDB.Path)
 	if err != nil {
 		sentry.CaptureException(err)
 		log.Fatalf("Failed to open MMDB: %v", err)
 	}
 
 	teamStats := &TeamStats{
-		Store: make(map[string]*expirable.LRU[string, string]),
+		TTL:                  configuredStatsTTL(),
+		TokenTTLs:            configuredTokenTTLs(),
+		MaxEventNames:        config.Stats.MaxEventNames,
+		TrimDistinctIDs:      config.Stats.DistinctIDs.Trim,
+		LowercaseDistinctIDs: config.Stats.DistinctIDs.Lowercase,
+		GracePeriod:          config.Stats.GracePeriod,
+		PeakWindow:           config.Stats.PeakWindow,
+		TokenGroups:          configuredTokenGroups(),
+		MaxPropertyKeys:      config.Stats.PropertyKeys.MaxKeys,
+		Store:                make(map[string]*expirable.LRU[string, string]),
+		Pending:              make(map[string]*expirable.LRU[string, struct{}]),
+		Groups:               make(map[string]*expirable.LRU[string, struct{}]),
+		Peaks:                make(map[string]*userPeak),
+		Events:               make(map[string]*eventCounter),
+		Breakdowns:           make(map[string]map[string]*eventCounter),
+		Properties:           make(map[string]map[string]*eventCounter),
 	}
 
 	phEventChan := make(chan PostHogEvent)
@@ -72,177 +77,121 @@ func main() {
 	unSubChan := make(chan Subscription)
 
 	go teamStats.keepStats(statsChan)
+	go teamStats.reportActiveTokens(config.Stats.ActiveTokensInterval)
 
 	kafkaSecurityProtocol := "SSL"
 	if !isProd {
 		kafkaSecurityProtocol = "PLAINTEXT"
 	}
-	consumer, err := NewKafkaConsumer(brokers, kafkaSecurityProtocol, groupID, topic, geolocator, phEventChan, statsChan)
+	// With pub/sub enabled, consumed events go through Redis so every node
+	// sees them, rather than straight to this node's filter.
+	ingestedChan := phEventChan
+	var redisClient *redis.Client
+	var fanOut *PubSubFanOut
+	if config.Redis.PubSub.Enabled {
+		redisClient = redis.NewClient(&redis.Options{Addr: config.Redis.Address})
+
+		fanOut = NewPubSubFanOut(redisClient, phEventChan)
+		go fanOut.Run(context.Background())
+
+		ingestedChan = make(chan PostHogEvent)
+		go func() {
+			for event := range ingestedChan {
+				fanOut.Publish(event)
+			}
+		}()
+	}
+
+	consumer, err := NewKafkaConsumer(config.Kafka.Brokers, kafkaSecurityProtocol, config.Kafka.GroupID, config.Kafka.Topic, geolocator, ingestedChan, statsChan)
 	if err != nil {
 		sentry.CaptureException(err)
 		log.Fatalf("Failed to create Kafka consumer: %v", err)
 	}
-	defer consumer.Close()
 	go consumer.Consume()
 
-	filter := NewFilter(subChan, unSubChan, phEventChan)
+	// Ingested events pass through a bounded queue so bursts neither block
+	// ingestion immediately nor grow memory without limit.
+	queuedChan := make(chan PostHogEvent)
+	queue, err := NewIngestionQueue(phEventChan, queuedChan, config.Ingestion.QueueSize, config.Ingestion.OverflowPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go queue.Run()
+
+	filter := NewFilter(subChan, unSubChan, queuedChan)
+	if fanOut != nil {
+		// Only the tokens subscribed to here are received over pub/sub.
+		filter.SetObserver(fanOut)
+	}
 	go filter.Run()
 
+	webhookSinks, err := webhookSinksFromConfig()
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Fatal(err)
+	}
+	stopWebhookSinks := startWebhookSinks(filter, webhookSinks)
+
+	lifecycle := NewLifecycle()
+	lifecycle.DelayStart()
+
 	// Echo instance
 	e := echo.New()
 
+	// Behind trusted proxies, only believe the X-Forwarded-For entries they
+	// appended when working out a client's IP. Without any, the client is
+	// whoever connected: echo's default would believe any X-Forwarded-For, and
+	// so let clients pick the IP their auth backoff is kept under.
+	proxies, err := parseTrustedProxies(config.Server.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	e.IPExtractor = proxies.clientIP
+
+	// Headers are read before any route is known, so this guards every
+	// endpoint: a client trickling in its headers is cut off before it ties
+	// up a handler authenticating an /events subscription.
+	e.Server.ReadHeaderTimeout = config.Server.ReadHeaderTimeout
+
 	// Middleware
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 	e.Use(middleware.RequestID())
+	e.Use(limitBody())
 	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
 		Level: 9, // Set compression level to maximum
 	}))
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins: []string{"*"},
-		AllowMethods: []string{http.MethodGet, http.MethodHead},
+		AllowMethods: []string{http.MethodGet, http.MethodHead, http.MethodPost},
 	}))
 	e.File("/", "./index.html")
 
 	// Routes
 	e.GET("/", index)
 
-	e.GET("/stats", func(c echo.Context) error {
-
-		type stats struct {
-			UsersOnProduct int    `json:"users_on_product,omitempty"`
-			Error          string `json:"error,omitempty"`
-		}
-
-		authHeader := c.Request().Header.Get("Authorization")
-		if authHeader == "" {
-			return errors.New("authorization header is required")
-		}
-
-		claims, err := decodeAuthToken(authHeader)
-		if err != nil {
-			return err
-		}
-		teamIdInt := int(claims["team_id"].(float64))
-
-		token, err := tokenFromTeamId(teamIdInt)
-		if err != nil {
-			return err
-		}
+	e.GET("/stats", StatsHandler(teamStats), httpMetrics(false))
+	e.GET("/stats/stream", StatsStreamHandler(teamStats, lifecycle), httpMetrics(true))
 
-		var hash *expirable.LRU[string, string]
-		var ok bool
-		if hash, ok = teamStats.Store[token]; !ok {
-			resp := stats{
-				Error: "no stats",
-			}
-			return c.JSON(http.StatusOK, resp)
-		}
-
-		siteStats := stats{
-			UsersOnProduct: hash.Len(),
-		}
-		return c.JSON(http.StatusOK, siteStats)
-	})
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	e.GET("/health", HealthHandler(lifecycle))
 
-	e.GET("/events", func(c echo.Context) error {
-		e.Logger.Printf("SSE client connected, ip: %v", c.RealIP())
+	admin := e.Group("/admin", adminAuth())
+	admin.GET("/stats/:token/members", TokenMembersHandler(teamStats))
+	admin.GET("/stats/:token/property_keys", PropertyKeysHandler(teamStats))
+	admin.GET("/diagnostics", DiagnosticsHandler(teamStats, redisClient))
+	admin.POST("/tokens/:token/reconnect", ReconnectTokenHandler(filter))
 
-		teamId := c.QueryParam("teamId")
-		eventType := c.QueryParam("eventType")
-		distinctId := c.QueryParam("distinctId")
-		geo := c.QueryParam("geo")
-
-		teamIdInt := 0
-		token := ""
-		geoOnly := false
-
-		if strings.ToLower(geo) == "true" || geo == "1" {
-			geoOnly = true
-		} else {
-			teamId = ""
-
-			log.Println("~~~~ Looking for auth header")
-			authHeader := c.Request().Header.Get("Authorization")
-			if authHeader == "" {
-				return errors.New("authorization header is required")
-			}
-
-			log.Println("~~~~ decoding auth header")
-			claims, err := decodeAuthToken(authHeader)
-			if err != nil {
-				return err
-			}
-			teamId = strconv.Itoa(int(claims["team_id"].(float64)))
-
-			log.Printf("~~~~ team found %s", teamId)
-			if teamId == "" {
-				return errors.New("teamId is required unless geo=true")
-			}
-		}
-
-		if teamId != "" {
-			teamIdInt64, err := strconv.ParseInt(teamId, 10, 0)
-			if err != nil {
-				return err
-			}
-
-			teamIdInt := int(teamIdInt64)
-			token, err = tokenFromTeamId(teamIdInt)
-			if err != nil {
-				return err
-			}
-		}
-
-		eventTypes := []string{}
-		if eventType != "" {
-			eventTypes = strings.Split(eventType, ",")
-		}
-
-		subscription := Subscription{
-			TeamId:      teamIdInt,
-			Token:       token,
-			ClientId:    c.Response().Header().Get(echo.HeaderXRequestID),
-			DistinctId:  distinctId,
-			Geo:         geoOnly,
-			EventTypes:  eventTypes,
-			EventChan:   make(chan interface{}, 100),
-			ShouldClose: &atomic.Bool{},
-		}
-
-		subChan <- subscription
-
-		w := c.Response()
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-
-		for {
-			select {
-			case <-c.Request().Context().Done():
-				e.Logger.Printf("SSE client disconnected, ip: %v", c.RealIP())
-				filter.unSubChan <- subscription
-				subscription.ShouldClose.Store(true)
-				return nil
-			case payload := <-subscription.EventChan:
-				jsonData, err := json.Marshal(payload)
-				if err != nil {
-					sentry.CaptureException(err)
-					log.Println("Error marshalling payload", err)
-					continue
-				}
-
-				event := Event{
-					Data: jsonData,
-				}
-				if err := event.WriteTo(w); err != nil {
-					return err
-				}
-				w.Flush()
-			}
-		}
-	})
+	acks := NewAckRegistry()
+	controls := NewSubscriptionControls()
+	streamEvents := StreamEventsHandler(filter, lifecycle, acks, controls)
+	e.GET("/events", streamEvents, httpMetrics(true))
+	e.HEAD("/events", streamEvents, httpMetrics(false))
+	e.POST("/events/:id/ack", AckHandler(acks))
+	e.POST("/events/:id/pause", SignalHandler(controls, signalPause))
+	e.POST("/events/:id/resume", SignalHandler(controls, signalResume))
+	e.GET("/ws", WebSocketHandler(filter, lifecycle, acks), httpMetrics(true))
 
 	e.GET("/jwt", func(c echo.Context) error {
 		authHeader := c.Request().Header.Get("Authorization")
@@ -285,5 +234,37 @@ func main() {
 		}
 	})
 
-	e.Logger.Fatal(e.Start(":8080"))
+	go func() {
+		if err := e.Start(":8080"); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	log.Println("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Shutdown.Timeout)
+	defer cancel()
+
+	// Subscribers are drained first; only then is fan-out stopped, webhook
+	// sinks flushed and the server, Kafka consumer and Redis client closed.
+	lifecycle.Shutdown(shutdownCtx,
+		func(context.Context) error {
+			filter.Stop()
+			return nil
+		},
+		stopWebhookSinks,
+		e.Shutdown,
+		func(context.Context) error {
+			return consumer.Close()
+		},
+		func(context.Context) error {
+			if redisClient == nil {
+				return nil
+			}
+			return redisClient.Close()
+		},
+	)
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The metrics are registered by registerMetrics once the config is loaded,
+// so that metrics.namespace can prefix their names.
+var (
+	EventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "livestream_events_dropped_total",
+		Help: "Events dropped before reaching any subscriber, by reason.",
+	}, []string{"reason"})
+	EventsLate = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_events_late_total",
+		Help: "Events dropped by ordered subscriptions because they arrived after the ordering window.",
+	})
+	UnackedEventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_unacked_events_dropped_total",
+		Help: "Unacknowledged events discarded because a subscription's ack buffer was full.",
+	})
+	WebhookEventsDeadLettered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_webhook_events_dead_lettered_total",
+		Help: "Events a webhook sink gave up delivering after exhausting its retries.",
+	})
+	IngestionQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "livestream_ingestion_queue_depth",
+		Help: "Events waiting in the queue between ingestion and fan-out.",
+	})
+	ActiveTokens = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "livestream_active_tokens",
+		Help: "Tokens with at least one live user in their stats window.",
+	})
+	TokensNearExpiry = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_tokens_near_expiry_total",
+		Help: "Subscriptions opened with a JWT expiring within jwt.near_expiry_threshold.",
+	})
+	StatsQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "livestream_stats_queries_total",
+		Help: "Authorized /stats requests, by hashed token bucket (see tokenBucket).",
+	}, []string{"token_bucket"})
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "livestream_http_requests_total",
+		Help: "Completed HTTP requests, by route and status.",
+	}, []string{"route", "status"})
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "livestream_http_request_duration_seconds",
+		Help:    "Duration of short-lived HTTP requests, by route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "status"})
+	HTTPStreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "livestream_http_stream_duration_seconds",
+		Help:    "How long streaming connections stayed open, by route and status.",
+		Buckets: []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600, 24 * 3600},
+	}, []string{"route", "status"})
+	SubscriberBufferUtilization = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "livestream_subscriber_buffer_utilization_ratio",
+		Help:    "How full a subscriber's event buffer is after each event is queued for it, from 0 to 1.",
+		Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+	})
+	RejectedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "livestream_rejected_requests_total",
+		Help: "Requests rejected before reaching a handler, by reason.",
+	}, []string{"reason"})
+	PubSubEventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_pubsub_events_dropped_total",
+		Help: "Locally ingested events not shared with other nodes because the pub/sub publish queue was full.",
+	})
+	ObserverCallbacksDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_observer_callbacks_dropped_total",
+		Help: "Subscribe and unsubscribe callbacks not delivered to the subscription observer because it fell too far behind.",
+	})
+	SubscriptionSetupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "livestream_subscription_setup_duration_seconds",
+		Help:    "Time from receiving an /events request until the subscription is ready to deliver events.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+)
+
+// registerMetrics registers every metric above with registerer, which is
+// the default Prometheus registry outside tests. A non-empty namespace is
+// prepended to their names, e.g. "posthog" exposes
+// livestream_events_dropped_total as posthog_livestream_events_dropped_total.
+func registerMetrics(registerer prometheus.Registerer, namespace string) {
+	if namespace != "" {
+		registerer = prometheus.WrapRegistererWithPrefix(namespace+"_", registerer)
+	}
+	registerer.MustRegister(
+		EventsDropped,
+		EventsLate,
+		UnackedEventsDropped,
+		WebhookEventsDeadLettered,
+		IngestionQueueDepth,
+		ActiveTokens,
+		TokensNearExpiry,
+		StatsQueries,
+		HTTPRequests,
+		HTTPRequestDuration,
+		HTTPStreamDuration,
+		SubscriberBufferUtilization,
+		RejectedRequests,
+		SubscriptionSetupDuration,
+		PubSubEventsDropped,
+		ObserverCallbacksDropped,
+	)
+}
+
+// tokenBucket maps a token to one of metrics.token_buckets labels, so
+// per-token metrics stay bounded in cardinality and don't expose tokens.
+// Tokens can share a bucket; an abusive one still stands out against the
+// others in it.
+func tokenBucket(token string) string {
+	buckets := uint32(conf.Metrics.TokenBuckets)
+	if buckets == 0 {
+		buckets = 1
+	}
+	h := fnv.New32a()
+	h.Write([]byte(token))
+	return fmt.Sprintf("%03d", h.Sum32()%buckets)
+}
+
+// httpMetrics records the count and duration of requests to a route. Streaming
+// routes observe into HTTPStreamDuration, whose buckets suit connections that
+// stay open for minutes or hours.
+func httpMetrics(streaming bool) echo.MiddlewareFunc {
+	duration := HTTPRequestDuration
+	if streaming {
+		duration = HTTPStreamDuration
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+
+			// Errors haven't been written yet, so their status is on the error.
+			status := c.Response().Status
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else if err != nil && !c.Response().Committed {
+				status = http.StatusInternalServerError
+			}
+
+			labels := prometheus.Labels{"route": c.Path(), "status": strconv.Itoa(status)}
+			HTTPRequests.With(labels).Inc()
+			duration.With(labels).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
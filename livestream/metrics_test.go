@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestHTTPMetrics(t *testing.T) {
+	e := echo.New()
+	e.GET("/stats", func(c echo.Context) error {
+		return c.String(http.StatusOK, "{}")
+	}, httpMetrics(false))
+	e.GET("/stats/denied", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusUnauthorized, "no")
+	}, httpMetrics(false))
+	e.GET("/events", func(c echo.Context) error {
+		return c.String(http.StatusOK, "data: {}\n\n")
+	}, httpMetrics(true))
+
+	observations := func(duration *prometheus.HistogramVec, route, status string) uint64 {
+		var m dto.Metric
+		if err := duration.WithLabelValues(route, status).(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+
+	tests := []struct {
+		target   string
+		duration *prometheus.HistogramVec
+		status   string
+	}{
+		{target: "/stats", duration: HTTPRequestDuration, status: "200"},
+		{target: "/stats/denied", duration: HTTPRequestDuration, status: "401"},
+		{target: "/events", duration: HTTPStreamDuration, status: "200"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			requests := testutil.ToFloat64(HTTPRequests.WithLabelValues(tt.target, tt.status))
+			observed := observations(tt.duration, tt.target, tt.status)
+
+			e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if got := testutil.ToFloat64(HTTPRequests.WithLabelValues(tt.target, tt.status)) - requests; got != 1 {
+				t.Errorf("counted %v requests to %s with status %s, want 1", got, tt.target, tt.status)
+			}
+			if got := observations(tt.duration, tt.target, tt.status) - observed; got != 1 {
+				t.Errorf("observed %d durations for %s with status %s, want 1", got, tt.target, tt.status)
+			}
+		})
+	}
+}
+
+func TestRegisterMetricsNamespace(t *testing.T) {
+	tests := []struct {
+		namespace string
+		want      string
+	}{
+		{want: "livestream_events_late_total"},
+		{namespace: "posthog", want: "posthog_livestream_events_late_total"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			registerMetrics(registry, tt.namespace)
+
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, family := range families {
+				if !strings.HasPrefix(family.GetName(), tt.namespace) {
+					t.Errorf("%s registered outside the %q namespace", family.GetName(), tt.namespace)
+				}
+				found = found || family.GetName() == tt.want
+			}
+			if !found {
+				t.Errorf("%s isn't registered", tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// orderer re-sorts a subscription's events by timestamp. Each event is held
+// for the ordering window after it arrives so that earlier events arriving a
+// little late can still overtake it. Events older than the last one emitted
+// can no longer be delivered in order and are dropped.
+type orderer struct {
+	window      time.Duration
+	timer       *time.Timer
+	pending     orderedEvents
+	lastEmitted time.Time
+}
+
+type orderedEvent struct {
+	event     ResponsePostHogEvent
+	timestamp time.Time
+	deadline  time.Time
+}
+
+type orderedEvents []orderedEvent
+
+func (o orderedEvents) Len() int           { return len(o) }
+func (o orderedEvents) Less(i, j int) bool { return o[i].timestamp.Before(o[j].timestamp) }
+func (o orderedEvents) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o *orderedEvents) Push(x any)        { *o = append(*o, x.(orderedEvent)) }
+func (o *orderedEvents) Pop() any {
+	old := *o
+	n := len(old)
+	item := old[n-1]
+	*o = old[:n-1]
+	return item
+}
+
+func newOrderer(window time.Duration) *orderer {
+	timer := time.NewTimer(window)
+	timer.Stop()
+	return &orderer{window: window, timer: timer}
+}
+
+// add buffers event, reporting false if it arrived too late to be ordered.
+// Timestamps come from client clocks, so one in the future is treated as now:
+// otherwise a single skewed event would make every event after it late until
+// real time caught up. Events with an unparseable timestamp are ordered by
+// arrival time, which that clamp keeps comparable with the rest.
+func (o *orderer) add(event ResponsePostHogEvent, now time.Time) bool {
+	timestamp, err := time.Parse(time.RFC3339Nano, event.Timestamp)
+	if err != nil || timestamp.After(now) {
+		timestamp = now
+	}
+	if timestamp.Before(o.lastEmitted) {
+		return false
+	}
+
+	heap.Push(&o.pending, orderedEvent{event: event, timestamp: timestamp, deadline: now.Add(o.window)})
+	o.schedule(now)
+	return true
+}
+
+// ready pops the events whose hold time has passed, oldest first.
+func (o *orderer) ready(now time.Time) []ResponsePostHogEvent {
+	var events []ResponsePostHogEvent
+	for o.pending.Len() > 0 && !o.pending[0].deadline.After(now) {
+		next := heap.Pop(&o.pending).(orderedEvent)
+		o.lastEmitted = next.timestamp
+		events = append(events, next.event)
+	}
+	o.schedule(now)
+	return events
+}
+
+func (o *orderer) schedule(now time.Time) {
+	if o.pending.Len() > 0 {
+		o.timer.Reset(o.pending[0].deadline.Sub(now))
+	}
+}
+
+func (o *orderer) stop() {
+	o.timer.Stop()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOrderer(t *testing.T) {
+	start := time.Date(2024, 9, 1, 12, 0, 0, 0, time.UTC)
+	window := 2 * time.Second
+
+	type arrival struct {
+		uuid      string
+		timestamp string
+		at        time.Duration // since start
+	}
+	at := func(offset time.Duration) string {
+		return start.Add(offset).Format(time.RFC3339Nano)
+	}
+
+	tests := []struct {
+		name        string
+		arrivals    []arrival
+		wantOrder   []string
+		wantDropped []string
+	}{
+		{
+			name: "reordered within the window",
+			arrivals: []arrival{
+				{uuid: "2", timestamp: at(-time.Second), at: 0},
+				{uuid: "1", timestamp: at(-2 * time.Second), at: time.Second},
+				{uuid: "3", timestamp: at(time.Second), at: time.Second},
+			},
+			wantOrder: []string{"1", "2", "3"},
+		},
+		{
+			name: "late events are dropped",
+			arrivals: []arrival{
+				{uuid: "2", timestamp: at(0), at: 0},
+				{uuid: "1", timestamp: at(-time.Second), at: 3 * time.Second},
+				{uuid: "3", timestamp: at(3 * time.Second), at: 3 * time.Second},
+			},
+			wantOrder:   []string{"2", "3"},
+			wantDropped: []string{"1"},
+		},
+		{
+			name: "a timestamp in the future doesn't make later events late",
+			arrivals: []arrival{
+				{uuid: "future", timestamp: at(time.Hour), at: 0},
+				{uuid: "2", timestamp: at(3 * time.Second), at: 3 * time.Second},
+				{uuid: "3", timestamp: at(4 * time.Second), at: 4 * time.Second},
+			},
+			wantOrder: []string{"future", "2", "3"},
+		},
+		{
+			name: "unparseable timestamps are ordered by arrival",
+			arrivals: []arrival{
+				{uuid: "1", timestamp: at(-time.Second), at: 0},
+				{uuid: "unparseable", timestamp: "yesterday", at: 0},
+				{uuid: "3", timestamp: at(3 * time.Second), at: 3 * time.Second},
+			},
+			wantOrder: []string{"1", "unparseable", "3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOrderer(window)
+			defer o.stop()
+
+			var got, dropped []string
+			emit := func(now time.Time) {
+				for _, event := range o.ready(now) {
+					got = append(got, event.Uuid)
+				}
+			}
+			for _, a := range tt.arrivals {
+				now := start.Add(a.at)
+				emit(now)
+				if !o.add(ResponsePostHogEvent{Uuid: a.uuid, Timestamp: a.timestamp}, now) {
+					dropped = append(dropped, a.uuid)
+				}
+			}
+			emit(start.Add(time.Hour))
+
+			if !slices.Equal(got, tt.wantOrder) {
+				t.Errorf("emitted %v, want %v", got, tt.wantOrder)
+			}
+			if !slices.Equal(dropped, tt.wantDropped) {
+				t.Errorf("dropped %v, want %v", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	signalPause  = "pause"
+	signalResume = "resume"
+)
+
+// SubscriptionControls lets side requests, such as POST /events/:id/pause,
+// signal the handler goroutine serving a subscription. Like acks, they need
+// the JWT of the subscription's project.
+type SubscriptionControls struct {
+	mu       sync.Mutex
+	channels map[string]subscriptionControl
+}
+
+type subscriptionControl struct {
+	token   string
+	signals chan string
+}
+
+func NewSubscriptionControls() *SubscriptionControls {
+	return &SubscriptionControls{channels: make(map[string]subscriptionControl)}
+}
+
+// register starts accepting signals for subscription id, whose events are
+// for token.
+func (sc *SubscriptionControls) register(id string, token string) chan string {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	signals := make(chan string, 4)
+	sc.channels[id] = subscriptionControl{token: token, signals: signals}
+	return signals
+}
+
+func (sc *SubscriptionControls) unregister(id string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.channels, id)
+}
+
+// Send delivers signal to subscription id without blocking. It reports false
+// if the subscription isn't connected to this node, isn't for token, or isn't
+// keeping up.
+func (sc *SubscriptionControls) Send(id string, token string, signal string) bool {
+	sc.mu.Lock()
+	control, ok := sc.channels[id]
+	sc.mu.Unlock()
+	if !ok || control.token != token {
+		return false
+	}
+
+	select {
+	case control.signals <- signal:
+		return true
+	default:
+		return false
+	}
+}
+
+// SignalHandler forwards signal to the subscription named in the :id param.
+func SignalHandler(controls *SubscriptionControls, signal string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := tokenFromRequest(c)
+		if err != nil {
+			var authErr *authError
+			if errors.As(err, &authErr) {
+				return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+			}
+			return err
+		}
+
+		if !controls.Send(c.Param("id"), token, signal) {
+			return echo.NewHTTPError(http.StatusNotFound, "unknown subscription")
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// pauseBuffer holds a paused subscription's events, up to sse.pause_buffer_size,
+// so they can be delivered on resume. Events beyond the cap count as dropped.
+type pauseBuffer struct {
+	paused  bool
+	events  []interface{}
+	dropped *atomic.Int64
+}
+
+func newPauseBuffer(dropped *atomic.Int64) *pauseBuffer {
+	return &pauseBuffer{dropped: dropped}
+}
+
+// hold keeps payload back if the subscription is paused, reporting whether
+// it did.
+func (p *pauseBuffer) hold(payload interface{}) bool {
+	if !p.paused {
+		return false
+	}
+
+	if len(p.events) < conf.SSE.PauseBufferSize {
+		p.events = append(p.events, payload)
+	} else {
+		p.dropped.Add(1)
+	}
+	return true
+}
+
+func (p *pauseBuffer) pause() {
+	p.paused = true
+}
+
+// resume unpauses and returns the held events in arrival order.
+func (p *pauseBuffer) resume() []interface{} {
+	events := p.events
+	p.paused = false
+	p.events = nil
+	return events
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSubscriptionControlsSend(t *testing.T) {
+	tests := []struct {
+		name  string
+		id    string
+		token string
+		want  bool
+	}{
+		{name: "own token", id: "stream", token: "token", want: true},
+		{name: "another token", id: "stream", token: "other", want: false},
+		{name: "unknown subscription", id: "missing", token: "token", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controls := NewSubscriptionControls()
+			signals := controls.register("stream", "token")
+
+			if got := controls.Send(tt.id, tt.token, signalPause); got != tt.want {
+				t.Fatalf("Send() = %v, want %v", got, tt.want)
+			}
+			if got := len(signals) > 0; got != tt.want {
+				t.Errorf("signal delivered = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPauseBuffer(t *testing.T) {
+	setConfig(t, "sse.pause_buffer_size", 2)
+
+	dropped := &atomic.Int64{}
+	buffer := newPauseBuffer(dropped)
+	if buffer.hold("before") {
+		t.Error("held an event while not paused")
+	}
+
+	buffer.pause()
+	for _, event := range []string{"1", "2", "3"} {
+		if !buffer.hold(event) {
+			t.Errorf("didn't hold %q while paused", event)
+		}
+	}
+
+	if got, want := buffer.resume(), []interface{}{"1", "2"}; !slices.Equal(got, want) {
+		t.Errorf("resume() = %v, want %v", got, want)
+	}
+	if got := dropped.Load(); got != 1 {
+		t.Errorf("dropped %d events, want 1", got)
+	}
+	if buffer.hold("after") {
+		t.Error("held an event after resuming")
+	}
+}
@@ -2,8 +2,15 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"regexp"
+	"strings"
 )
 
+// teamToken looks up the project token of a team. Tests replace it so that
+// authenticated handlers can run without Postgres.
+var teamToken = tokenFromTeamId
+
 func tokenFromTeamId(teamId int) (string, error) {
 	pgConn, pgConnErr := getPGConn()
 	if pgConnErr != nil {
@@ -17,5 +24,31 @@ func tokenFromTeamId(teamId int) (string, error) {
 		return "", queryErr
 	}
 
-	return token, nil
+	return strings.TrimSpace(token), nil
+}
+
+// apiTokenPattern is auth.token_pattern, compiled once at startup by
+// setAPITokenPattern. nil turns the check off.
+var apiTokenPattern *regexp.Regexp
+
+// setAPITokenPattern compiles pattern for validateAPIToken. LoadConfig has
+// already checked that it compiles.
+func setAPITokenPattern(pattern string) {
+	apiTokenPattern = nil
+	if pattern != "" {
+		apiTokenPattern = regexp.MustCompile(pattern)
+	}
+}
+
+// validateAPIToken rejects tokens that don't match auth.token_pattern. The
+// check is off unless a pattern is configured, since older projects may have
+// tokens in other formats.
+func validateAPIToken(token string) error {
+	if apiTokenPattern == nil {
+		return nil
+	}
+	if !apiTokenPattern.MatchString(token) {
+		return fmt.Errorf("api token does not match the expected format %q", apiTokenPattern)
+	}
+	return nil
 }
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestValidateAPIToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		token   string
+		wantErr bool
+	}{
+		{name: "no pattern", pattern: "", token: "anything"},
+		{name: "matching token", pattern: `^phc_[A-Za-z0-9]+$`, token: "phc_abc123"},
+		{name: "other format", pattern: `^phc_[A-Za-z0-9]+$`, token: "sTMFPsFhdP1Ssg", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAPITokenPattern(tt.pattern)
+			t.Cleanup(func() { setAPITokenPattern("") })
+
+			if err := validateAPIToken(tt.token); (err != nil) != tt.wantErr {
+				t.Errorf("validateAPIToken(%q) error = %v, wantErr %v", tt.token, err, tt.wantErr)
+			}
+		})
+	}
+}
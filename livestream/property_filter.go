@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+const (
+	OperatorExact      = "exact"
+	OperatorStartsWith = "startswith"
+	OperatorEndsWith   = "endswith"
+	OperatorContains   = "contains"
+	OperatorRegex      = "regex"
+
+	OperatorGreaterThan        = "gt"
+	OperatorGreaterThanOrEqual = "gte"
+	OperatorLessThan           = "lt"
+	OperatorLessThanOrEqual    = "lte"
+)
+
+// PropertyFilter matches an event property against a value, e.g.
+// {"key": "$current_url", "operator": "startswith", "value": "/checkout"}.
+// Instead of a key it can hold a group of filters that match when all of them
+// do ({"and": [...]}) or when any of them does ({"or": [...]}). Groups nest.
+type PropertyFilter struct {
+	Key      string      `json:"key"`
+	Operator string      `json:"operator,omitempty"`
+	Value    interface{} `json:"value"`
+
+	And []PropertyFilter `json:"and,omitempty"`
+	Or  []PropertyFilter `json:"or,omitempty"`
+
+	regex  *regexp.Regexp
+	number float64
+}
+
+// regexCache holds compiled patterns shared by all subscriptions so that many
+// clients using the same filter only compile it once.
+var regexCache, _ = lru.New[string, *regexp.Regexp](1000)
+
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	maxLength := conf.Filters.MaxRegexLength
+	if maxLength > 0 && len(pattern) > maxLength {
+		return nil, fmt.Errorf("regex is longer than %d characters", maxLength)
+	}
+
+	if re, ok := regexCache.Get(pattern); ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexCache.Add(pattern, re)
+	return re, nil
+}
+
+// parsePropertyFilters decodes and validates the JSON list of property
+// filters passed by a subscriber.
+func parsePropertyFilters(raw string) ([]PropertyFilter, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var filters []PropertyFilter
+	if err := json.Unmarshal([]byte(raw), &filters); err != nil {
+		return nil, fmt.Errorf("invalid properties filter: %w", err)
+	}
+
+	conditions := 0
+	if err := validatePropertyFilters(filters, 0, &conditions); err != nil {
+		return nil, err
+	}
+	orderByCost(filters)
+
+	return filters, nil
+}
+
+// orderByCost sorts filters, and the filters within groups, so the cheapest
+// run first. Matching stops at the first filter that decides the result, so
+// a quick comparison that rules an event out saves running a regex or
+// walking a nested path. Both and and or are order independent, so this
+// never changes what matches.
+func orderByCost(filters []PropertyFilter) {
+	for i := range filters {
+		orderByCost(filters[i].And)
+		orderByCost(filters[i].Or)
+	}
+	sort.SliceStable(filters, func(i, j int) bool {
+		return filters[i].cost() < filters[j].cost()
+	})
+}
+
+// cost roughly ranks how expensive a filter is to match: exact and numeric
+// comparisons are cheapest, then substring checks, then regexes, with each
+// level of a dotted path adding to it. A group costs as much as all of its
+// filters.
+func (f PropertyFilter) cost() int {
+	if f.And != nil || f.Or != nil {
+		total := 1
+		for _, filter := range f.And {
+			total += filter.cost()
+		}
+		for _, filter := range f.Or {
+			total += filter.cost()
+		}
+		return total
+	}
+
+	cost := strings.Count(f.Key, ".")
+	switch f.Operator {
+	case OperatorStartsWith, OperatorEndsWith, OperatorContains:
+		cost += 2
+	case OperatorRegex:
+		cost += 8
+	default:
+		cost++
+	}
+	return cost
+}
+
+// validatePropertyFilters checks filters, and any groups within them, in
+// place. depth is how many groups filters are nested in, and conditions counts
+// the leaf conditions seen so far, so the total cost of a subscription's
+// filters stays bounded.
+func validatePropertyFilters(filters []PropertyFilter, depth int, conditions *int) error {
+	for i := range filters {
+		f := &filters[i]
+		if f.And != nil || f.Or != nil {
+			if f.Key != "" || (f.And != nil && f.Or != nil) {
+				return fmt.Errorf("property filter %d must be either a condition or a single and/or group", i)
+			}
+			if depth >= conf.Filters.MaxGroupDepth {
+				return fmt.Errorf("property filter groups are nested deeper than %d levels", conf.Filters.MaxGroupDepth)
+			}
+			group := f.And
+			if f.Or != nil {
+				group = f.Or
+			}
+			if len(group) == 0 {
+				return fmt.Errorf("property filter %d has an empty group", i)
+			}
+			if err := validatePropertyFilters(group, depth+1, conditions); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if f.Key == "" {
+			return fmt.Errorf("property filter %d is missing a key", i)
+		}
+		if *conditions++; *conditions > conf.Filters.MaxConditions {
+			return fmt.Errorf("property filters have more than %d conditions", conf.Filters.MaxConditions)
+		}
+		if maxDepth := conf.Filters.MaxPathDepth; maxDepth > 0 && len(strings.Split(f.Key, ".")) > maxDepth {
+			return fmt.Errorf("property filter %q is nested deeper than %d levels", f.Key, maxDepth)
+		}
+
+		switch f.Operator {
+		case "":
+			f.Operator = OperatorExact
+		case OperatorExact:
+		case OperatorStartsWith, OperatorEndsWith, OperatorContains, OperatorRegex:
+			pattern, ok := f.Value.(string)
+			if !ok {
+				return fmt.Errorf("property filter %q: %s needs a string value", f.Key, f.Operator)
+			}
+			if f.Operator == OperatorRegex {
+				re, err := compileRegex(pattern)
+				if err != nil {
+					return fmt.Errorf("property filter %q: %w", f.Key, err)
+				}
+				f.regex = re
+			}
+		case OperatorGreaterThan, OperatorGreaterThanOrEqual, OperatorLessThan, OperatorLessThanOrEqual:
+			number, ok := toNumber(f.Value)
+			if !ok {
+				return fmt.Errorf("property filter %q: %s needs a numeric value", f.Key, f.Operator)
+			}
+			f.number = number
+		default:
+			return fmt.Errorf("property filter %q: unknown operator %q", f.Key, f.Operator)
+		}
+	}
+
+	return nil
+}
+
+// lookupProperty finds key in properties. A key that isn't a property itself
+// is treated as a dot separated path into nested objects, e.g. "$set.plan".
+func lookupProperty(properties map[string]interface{}, key string) (interface{}, bool) {
+	if value, ok := properties[key]; ok {
+		return value, true
+	}
+
+	path := strings.Split(key, ".")
+	var current interface{} = properties
+	for _, part := range path {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func (f PropertyFilter) matches(properties map[string]interface{}) bool {
+	if f.And != nil {
+		for _, filter := range f.And {
+			if !filter.matches(properties) {
+				return false
+			}
+		}
+		return true
+	}
+	if f.Or != nil {
+		for _, filter := range f.Or {
+			if filter.matches(properties) {
+				return true
+			}
+		}
+		return false
+	}
+
+	value, ok := lookupProperty(properties, f.Key)
+	if !ok {
+		return false
+	}
+
+	if f.Operator == OperatorExact {
+		return reflect.DeepEqual(value, f.Value)
+	}
+
+	switch f.Operator {
+	case OperatorGreaterThan, OperatorGreaterThanOrEqual, OperatorLessThan, OperatorLessThanOrEqual:
+		number, ok := toNumber(value)
+		if !ok {
+			return false
+		}
+		switch f.Operator {
+		case OperatorGreaterThan:
+			return number > f.number
+		case OperatorGreaterThanOrEqual:
+			return number >= f.number
+		case OperatorLessThan:
+			return number < f.number
+		default:
+			return number <= f.number
+		}
+	}
+
+	str, ok := value.(string)
+	if !ok {
+		return false
+	}
+	pattern := f.Value.(string)
+
+	switch f.Operator {
+	case OperatorStartsWith:
+		return strings.HasPrefix(str, pattern)
+	case OperatorEndsWith:
+		return strings.HasSuffix(str, pattern)
+	case OperatorContains:
+		return strings.Contains(str, pattern)
+	case OperatorRegex:
+		return f.regex.MatchString(str)
+	}
+	return false
+}
+
+// toNumber converts a decoded JSON number to a float64. Properties usually
+// decode as float64, but json.Number and Go integer types are accepted too.
+// Numeric strings are not numbers.
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func setFilterLimits(t testing.TB) {
+	setConfig(t, "filters.max_regex_length", 256)
+	setConfig(t, "filters.max_path_depth", 10)
+	setConfig(t, "filters.max_group_depth", 4)
+	setConfig(t, "filters.max_conditions", 32)
+}
+
+// mixedCostFilters are written most expensive first, with the cheap exact
+// match that rules most events out last.
+const mixedCostFilters = `[
+	{"key": "$current_url", "operator": "regex", "value": "^https://[a-z]+\\.example\\.com/(checkout|cart)/[0-9]+$"},
+	{"key": "$set.company.plan", "operator": "contains", "value": "enterprise"},
+	{"key": "$browser", "value": "Firefox"}
+]`
+
+// declaredOrder parses raw like parsePropertyFilters but keeps the filters in
+// the order they were written.
+func declaredOrder(t testing.TB, raw string) []PropertyFilter {
+	t.Helper()
+	var filters []PropertyFilter
+	if err := json.Unmarshal([]byte(raw), &filters); err != nil {
+		t.Fatal(err)
+	}
+	conditions := 0
+	if err := validatePropertyFilters(filters, 0, &conditions); err != nil {
+		t.Fatal(err)
+	}
+	return filters
+}
+
+func TestOrderByCostKeepsMatches(t *testing.T) {
+	setFilterLimits(t)
+
+	ordered, err := parsePropertyFilters(mixedCostFilters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ordered[0].Key != "$browser" || ordered[len(ordered)-1].Operator != OperatorRegex {
+		t.Errorf("got order %v, want the exact match first and the regex last", ordered)
+	}
+	declared := declaredOrder(t, mixedCostFilters)
+
+	for _, properties := range []map[string]interface{}{
+		{"$browser": "Chrome"},
+		{"$browser": "Firefox"},
+		{"$browser": "Firefox", "$current_url": "https://shop.example.com/cart/12"},
+		{"$browser": "Firefox", "$current_url": "https://shop.example.com/cart/12", "$set": map[string]interface{}{"company": map[string]interface{}{"plan": "enterprise-2024"}}},
+		{"$browser": "Chrome", "$current_url": "https://shop.example.com/cart/12", "$set": map[string]interface{}{"company": map[string]interface{}{"plan": "enterprise-2024"}}},
+	} {
+		event := PostHogEvent{Token: "token", Properties: properties}
+		got := Subscription{Token: "token", Properties: ordered}.matches(event, false)
+		want := Subscription{Token: "token", Properties: declared}.matches(event, false)
+		if got != want {
+			t.Errorf("matches(%v) = %v in cost order, %v in declared order", properties, got, want)
+		}
+	}
+}
+
+func BenchmarkMatches(b *testing.B) {
+	setFilterLimits(b)
+
+	ordered, err := parsePropertyFilters(mixedCostFilters)
+	if err != nil {
+		b.Fatal(err)
+	}
+	event := PostHogEvent{
+		Token: "token",
+		Event: "$pageview",
+		Properties: map[string]interface{}{
+			"$browser":     "Chrome",
+			"$current_url": "https://shop.example.com/checkout/1234",
+			"$set":         map[string]interface{}{"company": map[string]interface{}{"plan": "enterprise"}},
+		},
+	}
+
+	for _, bench := range []struct {
+		name string
+		sub  Subscription
+	}{
+		{"declared order", Subscription{Token: "token", Properties: declaredOrder(b, mixedCostFilters)}},
+		{"cost order", Subscription{Token: "token", Properties: ordered}},
+		{"event name first", Subscription{Token: "token", EventTypes: []string{"$autocapture"}, Properties: ordered}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bench.sub.matches(event, false)
+			}
+		})
+	}
+}
+
+func TestStringOperators(t *testing.T) {
+	setFilterLimits(t)
+	setConfig(t, "filters.max_regex_length", 16)
+	properties := map[string]interface{}{
+		"$current_url": "/checkout/cart",
+		"count":        3.0,
+	}
+
+	tests := []struct {
+		name    string
+		filter  string
+		want    bool
+		wantErr bool
+	}{
+		{name: "startswith", filter: `{"key": "$current_url", "operator": "startswith", "value": "/checkout"}`, want: true},
+		{name: "startswith mismatch", filter: `{"key": "$current_url", "operator": "startswith", "value": "/cart"}`},
+		{name: "endswith", filter: `{"key": "$current_url", "operator": "endswith", "value": "/cart"}`, want: true},
+		{name: "endswith mismatch", filter: `{"key": "$current_url", "operator": "endswith", "value": "/checkout"}`},
+		{name: "contains", filter: `{"key": "$current_url", "operator": "contains", "value": "out/ca"}`, want: true},
+		{name: "contains mismatch", filter: `{"key": "$current_url", "operator": "contains", "value": "basket"}`},
+		{name: "regex", filter: `{"key": "$current_url", "operator": "regex", "value": "^/check.*/cart$"}`, want: true},
+		{name: "regex mismatch", filter: `{"key": "$current_url", "operator": "regex", "value": "^/cart"}`},
+		{name: "non-string property", filter: `{"key": "count", "operator": "contains", "value": "3"}`},
+		{name: "missing property", filter: `{"key": "$pathname", "operator": "startswith", "value": "/"}`},
+		{name: "invalid regex", filter: `{"key": "$current_url", "operator": "regex", "value": "(unclosed"}`, wantErr: true},
+		{name: "regex over filters.max_regex_length", filter: `{"key": "$current_url", "operator": "regex", "value": "^(a+)+(b+)+(c+)+$"}`, wantErr: true},
+		{name: "non-string value", filter: `{"key": "$current_url", "operator": "startswith", "value": 1}`, wantErr: true},
+		{name: "unknown operator", filter: `{"key": "$current_url", "operator": "like", "value": "%cart%"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters, err := parsePropertyFilters("[" + tt.filter + "]")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePropertyFilters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := filters[0].matches(properties); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumericOperators(t *testing.T) {
+	setFilterLimits(t)
+
+	tests := []struct {
+		name     string
+		operator string
+		value    interface{}
+		property interface{}
+		want     bool
+	}{
+		{name: "gt", operator: OperatorGreaterThan, value: 100, property: 150.5, want: true},
+		{name: "gt equal", operator: OperatorGreaterThan, value: 100, property: 100.0},
+		{name: "gte equal", operator: OperatorGreaterThanOrEqual, value: 100, property: 100.0, want: true},
+		{name: "gte below", operator: OperatorGreaterThanOrEqual, value: 100, property: 99.9},
+		{name: "lt", operator: OperatorLessThan, value: 0.5, property: 0.25, want: true},
+		{name: "lt equal", operator: OperatorLessThan, value: 0.5, property: 0.5},
+		{name: "lte equal", operator: OperatorLessThanOrEqual, value: 0.5, property: 0.5, want: true},
+		{name: "lte above", operator: OperatorLessThanOrEqual, value: 0.5, property: 1.0},
+		{name: "integer property against float value", operator: OperatorGreaterThan, value: 99.5, property: 100, want: true},
+		{name: "json.Number property", operator: OperatorGreaterThan, value: 100, property: json.Number("101"), want: true},
+		{name: "numeric string isn't a number", operator: OperatorGreaterThan, value: 100, property: "150"},
+		{name: "bool isn't a number", operator: OperatorLessThan, value: 100, property: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := json.Marshal([]map[string]interface{}{{"key": "revenue", "operator": tt.operator, "value": tt.value}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			filters, err := parsePropertyFilters(string(raw))
+			if err != nil {
+				t.Fatalf("parsePropertyFilters() error: %v", err)
+			}
+			if got := filters[0].matches(map[string]interface{}{"revenue": tt.property}); got != tt.want {
+				t.Errorf("revenue %v %s %v = %v, want %v", tt.property, tt.operator, tt.value, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parsePropertyFilters(`[{"key": "revenue", "operator": "gt", "value": "100"}]`); err == nil {
+		t.Error("parsePropertyFilters accepted a non-numeric value for gt")
+	}
+}
+
+func TestPropertyPathDepth(t *testing.T) {
+	setFilterLimits(t)
+	path := func(depth int) string {
+		return strings.TrimSuffix(strings.Repeat("a.", depth), ".")
+	}
+
+	atLimit := fmt.Sprintf(`[{"key": %q, "value": "x"}]`, path(10))
+	filters, err := parsePropertyFilters(atLimit)
+	if err != nil {
+		t.Fatalf("path at the depth limit rejected: %v", err)
+	}
+	var properties interface{} = "x"
+	for i := 0; i < 10; i++ {
+		properties = map[string]interface{}{"a": properties}
+	}
+	event := PostHogEvent{Token: "token", Properties: properties.(map[string]interface{})}
+	if !(Subscription{Token: "token", Properties: filters}).matches(event, false) {
+		t.Error("path at the depth limit didn't match the nested property")
+	}
+
+	// An over-deep path is a bad request, not a stream that never matches.
+	overLimit := fmt.Sprintf(`[{"key": %q, "value": "x"}]`, path(11))
+	if _, err := parsePropertyFilters(overLimit); err == nil {
+		t.Error("path over the depth limit accepted")
+	}
+	filter, _ := newTestFilter(t)
+	handler := StreamEventsHandler(filter, NewLifecycle(), NewAckRegistry(), NewSubscriptionControls())
+	req := httptest.NewRequest(http.MethodGet, "/events?geo=true&properties="+url.QueryEscape(overLimit), nil)
+	var httpErr *echo.HTTPError
+	if err := handler(echo.New().NewContext(req, httptest.NewRecorder())); !errors.As(err, &httpErr) || httpErr.Code != http.StatusBadRequest {
+		t.Errorf("stream with an over-deep path returned %v, want a 400", err)
+	}
+}
+
+func TestFilterGroups(t *testing.T) {
+	setFilterLimits(t)
+	setConfig(t, "filters.max_group_depth", 2)
+	setConfig(t, "filters.max_conditions", 4)
+
+	// plan=enterprise OR seats>50
+	const either = `[{"or": [
+		{"key": "plan", "value": "enterprise"},
+		{"key": "seats", "operator": "gt", "value": 50}
+	]}]`
+	// $browser=Firefox AND (plan=enterprise OR (plan=team AND seats>50))
+	const nested = `[
+		{"key": "$browser", "value": "Firefox"},
+		{"or": [
+			{"key": "plan", "value": "enterprise"},
+			{"and": [{"key": "plan", "value": "team"}, {"key": "seats", "operator": "gt", "value": 50}]}
+		]}
+	]`
+
+	tests := []struct {
+		name       string
+		filters    string
+		properties map[string]interface{}
+		want       bool
+		wantErr    bool
+	}{
+		{name: "or, first branch", filters: either, properties: map[string]interface{}{"plan": "enterprise", "seats": 5.0}, want: true},
+		{name: "or, second branch", filters: either, properties: map[string]interface{}{"plan": "team", "seats": 80.0}, want: true},
+		{name: "or, neither branch", filters: either, properties: map[string]interface{}{"plan": "team", "seats": 5.0}},
+		{name: "and within or", filters: nested, properties: map[string]interface{}{"$browser": "Firefox", "plan": "team", "seats": 80.0}, want: true},
+		{name: "and within or, half of the and", filters: nested, properties: map[string]interface{}{"$browser": "Firefox", "plan": "team", "seats": 5.0}},
+		{name: "and within or, outer condition fails", filters: nested, properties: map[string]interface{}{"$browser": "Chrome", "plan": "enterprise"}},
+		{
+			name:    "too many conditions",
+			filters: `[{"or": [{"key": "a", "value": 1}, {"key": "b", "value": 1}, {"key": "c", "value": 1}, {"key": "d", "value": 1}, {"key": "e", "value": 1}]}]`,
+			wantErr: true,
+		},
+		{name: "groups nested too deep", filters: `[{"or": [{"and": [{"or": [{"key": "a", "value": 1}]}]}]}]`, wantErr: true},
+		{name: "empty group", filters: `[{"or": []}]`, wantErr: true},
+		{name: "both and and or", filters: `[{"and": [{"key": "a", "value": 1}], "or": [{"key": "b", "value": 1}]}]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters, err := parsePropertyFilters(tt.filters)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePropertyFilters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			sub := Subscription{Token: "token", Properties: filters}
+			if got := sub.matches(PostHogEvent{Token: "token", Properties: tt.properties}, false); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
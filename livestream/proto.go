@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ProtobufContentType is the media type clients send in Accept to get stats
+// encoded as the StatsResponse message in stats.proto.
+const ProtobufContentType = "application/x-protobuf"
+
+// MarshalProto encodes r as the StatsResponse message defined in stats.proto.
+func (r StatsResponse) MarshalProto() []byte {
+	var b []byte
+	if r.UsersOnProduct != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(r.UsersOnProduct))
+	}
+	if r.Events != nil {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*r.Events))
+	}
+	for name, count := range r.Breakdown {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, name)
+		entry = protowire.AppendTag(entry, 2, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, uint64(count))
+
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if r.UsersPeak != nil {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*r.UsersPeak))
+	}
+	if r.EventsPerMinute != nil {
+		b = protowire.AppendTag(b, 6, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(*r.EventsPerMinute))
+	}
+	if r.GroupUsersOnProduct != nil {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*r.GroupUsersOnProduct))
+	}
+	if r.Error != "" {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendString(b, r.Error)
+	}
+	return b
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var protoFieldPattern = regexp.MustCompile(`(?m)^\s*(optional\s+)?(map<string, int64>|\w+)\s+(\w+)\s*=\s*(\d+);`)
+
+// statsResponseDescriptor builds the StatsResponse message from the fields
+// declared in stats.proto, so that MarshalProto is checked against the schema
+// clients generate code from rather than against itself.
+func statsResponseDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	source, err := os.ReadFile("stats.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scalarTypes := map[string]descriptorpb.FieldDescriptorProto_Type{
+		"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+		"double": descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+		"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	}
+	message := &descriptorpb.DescriptorProto{Name: proto.String("StatsResponse")}
+	for _, match := range protoFieldPattern.FindAllStringSubmatch(string(source), -1) {
+		optional, typ, name := match[1] != "", match[2], match[3]
+		number, _ := strconv.Atoi(match[4])
+		field := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(int32(number)),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+
+		switch {
+		case typ == "map<string, int64>":
+			entry := &descriptorpb.DescriptorProto{
+				Name:    proto.String("BreakdownEntry"),
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("key"), JsonName: proto.String("key"), Number: proto.Int32(1), Label: field.Label, Type: scalarTypes["string"].Enum()},
+					{Name: proto.String("value"), JsonName: proto.String("value"), Number: proto.Int32(2), Label: field.Label, Type: scalarTypes["int64"].Enum()},
+				},
+			}
+			message.NestedType = append(message.NestedType, entry)
+			field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+			field.TypeName = proto.String(".livestream.StatsResponse.BreakdownEntry")
+		case scalarTypes[typ] != 0:
+			field.Type = scalarTypes[typ].Enum()
+		default:
+			t.Fatalf("stats.proto field %s has type %s, which this test doesn't handle", name, typ)
+		}
+
+		if optional {
+			// proto3 optional fields sit in a synthetic oneof of their own.
+			field.Proto3Optional = proto.Bool(true)
+			field.OneofIndex = proto.Int32(int32(len(message.OneofDecl)))
+			message.OneofDecl = append(message.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String("_" + name)})
+		}
+		message.Field = append(message.Field, field)
+	}
+
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        proto.String("stats.proto"),
+		Package:     proto.String("livestream"),
+		Syntax:      proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{message},
+	}, nil)
+	if err != nil {
+		t.Fatalf("building a descriptor from stats.proto: %v", err)
+	}
+	return file.Messages().ByName("StatsResponse")
+}
+
+// unmarshalStats decodes b with the stats.proto schema back into a
+// StatsResponse.
+func unmarshalStats(t *testing.T, desc protoreflect.MessageDescriptor, b []byte) StatsResponse {
+	t.Helper()
+	msg := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(b, msg); err != nil {
+		t.Fatalf("stats.proto can't decode MarshalProto output: %v", err)
+	}
+	if unknown := msg.GetUnknown(); len(unknown) > 0 {
+		t.Errorf("MarshalProto wrote %d bytes stats.proto doesn't declare", len(unknown))
+	}
+
+	fields := desc.Fields()
+	optionalInt := func(name protoreflect.Name) *int {
+		field := fields.ByName(name)
+		if !msg.Has(field) {
+			return nil
+		}
+		v := int(msg.Get(field).Int())
+		return &v
+	}
+
+	var r StatsResponse
+	r.UsersOnProduct = int(msg.Get(fields.ByName("users_on_product")).Int())
+	r.Events = optionalInt("events")
+	r.UsersPeak = optionalInt("users_peak")
+	r.GroupUsersOnProduct = optionalInt("group_users_on_product")
+	if field := fields.ByName("events_per_minute"); msg.Has(field) {
+		v := msg.Get(field).Float()
+		r.EventsPerMinute = &v
+	}
+	if field := fields.ByName("breakdown"); msg.Has(field) {
+		r.Breakdown = make(map[string]int)
+		msg.Get(field).Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			r.Breakdown[k.String()] = int(v.Int())
+			return true
+		})
+	}
+	r.Error = msg.Get(fields.ByName("error")).String()
+	return r
+}
+
+func TestMarshalProtoRoundTrip(t *testing.T) {
+	desc := statsResponseDescriptor(t)
+	intPtr := func(v int) *int { return &v }
+	floatPtr := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name     string
+		response StatsResponse
+	}{
+		{name: "empty"},
+		{name: "users only", response: StatsResponse{UsersOnProduct: 12}},
+		{name: "error", response: StatsResponse{Error: "no stats"}},
+		{
+			name: "every field",
+			response: StatsResponse{
+				UsersOnProduct:      12,
+				Events:              intPtr(340),
+				Breakdown:           map[string]int{"$pageview": 300, "$autocapture": 40},
+				UsersPeak:           intPtr(20),
+				EventsPerMinute:     floatPtr(5.5),
+				GroupUsersOnProduct: intPtr(15),
+			},
+		},
+		{
+			// Requested but zero must still be present, unlike a field that
+			// wasn't asked for.
+			name:     "requested zeros",
+			response: StatsResponse{Events: intPtr(0), UsersPeak: intPtr(0), EventsPerMinute: floatPtr(0), GroupUsersOnProduct: intPtr(0)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unmarshalStats(t, desc, tt.response.MarshalProto())
+			if !reflect.DeepEqual(got, tt.response) {
+				t.Errorf("round trip gave %+v, want %+v", got, tt.response)
+			}
+		})
+	}
+}
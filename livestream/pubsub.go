@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/redis/go-redis/v9"
+)
+
+const pubSubChannelPrefix = "livestream:events:"
+
+// pubSubDedupeWindow is how long an event's uuid is remembered, so its echo
+// from Redis, or a copy from another node, is dropped. Echoes normally arrive
+// within milliseconds.
+const pubSubDedupeWindow = time.Minute
+
+// PubSubFanOut shares ingested events between livestream nodes over Redis
+// Pub/Sub, so a client receives a token's events no matter which node
+// consumed them from Kafka. Every event is published on a per-token channel,
+// and each node only subscribes to the channels of tokens it has subscribers
+// for. It learns which those are as the filter's SubscriptionObserver. A
+// subscriber that isn't scoped to a token, such as a geo stream, makes the node
+// pattern-subscribe to every channel. Local events are still delivered
+// directly; the echo from Redis is dropped by uuid.
+type PubSubFanOut struct {
+	client       *redis.Client
+	outgoingChan chan PostHogEvent
+
+	// publishQueue holds events waiting to be published, so a slow Redis
+	// doesn't hold up ingestion. When it is full, events are only delivered
+	// locally.
+	publishQueue chan PostHogEvent
+
+	mu   sync.Mutex
+	seen *seenUUIDs
+	// tokens counts local subscriptions by token, with "" counting those
+	// not scoped to a token.
+	tokens map[string]int
+	// changed is signalled when a token gains its first subscription or
+	// loses its last, so Run updates what it is subscribed to.
+	changed chan struct{}
+}
+
+func NewPubSubFanOut(client *redis.Client, outgoingChan chan PostHogEvent) *PubSubFanOut {
+	return &PubSubFanOut{
+		client:       client,
+		outgoingChan: outgoingChan,
+		publishQueue: make(chan PostHogEvent, conf.Redis.PubSub.QueueSize),
+		seen:         newSeenUUIDs(pubSubDedupeWindow),
+		tokens:       make(map[string]int),
+		changed:      make(chan struct{}, 1),
+	}
+}
+
+// OnSubscribe implements SubscriptionObserver.
+func (p *PubSubFanOut) OnSubscribe(sub Subscription) {
+	p.mu.Lock()
+	p.tokens[sub.Token]++
+	first := p.tokens[sub.Token] == 1
+	p.mu.Unlock()
+
+	if first {
+		p.signalChanged()
+	}
+}
+
+// OnUnsubscribe implements SubscriptionObserver.
+func (p *PubSubFanOut) OnUnsubscribe(sub Subscription) {
+	p.mu.Lock()
+	p.tokens[sub.Token]--
+	last := p.tokens[sub.Token] <= 0
+	if last {
+		delete(p.tokens, sub.Token)
+	}
+	p.mu.Unlock()
+
+	if last {
+		p.signalChanged()
+	}
+}
+
+func (p *PubSubFanOut) signalChanged() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+		// Run hasn't caught up with the last change yet and will see
+		// this one too.
+	}
+}
+
+// seenUUIDs remembers uuids for at least window and at most twice that. Unlike
+// a size-capped cache it never forgets a uuid early under load; instead its
+// memory grows with the event rate, to about two windows' worth of uuids.
+type seenUUIDs struct {
+	window    time.Duration
+	rotatedAt time.Time
+	current   map[string]struct{}
+	previous  map[string]struct{}
+}
+
+func newSeenUUIDs(window time.Duration) *seenUUIDs {
+	return &seenUUIDs{
+		window:    window,
+		rotatedAt: time.Now(),
+		current:   make(map[string]struct{}),
+		previous:  make(map[string]struct{}),
+	}
+}
+
+// add marks uuid as seen, reporting false if it already was.
+func (s *seenUUIDs) add(uuid string, now time.Time) bool {
+	if elapsed := now.Sub(s.rotatedAt); elapsed >= 2*s.window {
+		s.previous = make(map[string]struct{})
+		s.current = make(map[string]struct{})
+		s.rotatedAt = now
+	} else if elapsed >= s.window {
+		s.previous = s.current
+		s.current = make(map[string]struct{}, len(s.previous))
+		s.rotatedAt = now
+	}
+
+	if _, ok := s.current[uuid]; ok {
+		return false
+	}
+	if _, ok := s.previous[uuid]; ok {
+		return false
+	}
+	s.current[uuid] = struct{}{}
+	return true
+}
+
+// firstSighting reports whether uuid hasn't been delivered yet and marks it as
+// delivered.
+func (p *PubSubFanOut) firstSighting(uuid string) bool {
+	if uuid == "" {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.seen.add(uuid, time.Now())
+}
+
+// Publish delivers a locally ingested event and queues it to be shared with
+// other nodes. Local delivery always happens; if Redis is failing or falling
+// behind, only other nodes miss the event.
+func (p *PubSubFanOut) Publish(event PostHogEvent) {
+	event.Instance = InstanceID()
+	if p.firstSighting(event.Uuid) {
+		p.outgoingChan <- event
+	}
+
+	select {
+	case p.publishQueue <- event:
+	default:
+		PubSubEventsDropped.Inc()
+	}
+}
+
+// publish sends queued events to Redis until ctx is done.
+func (p *PubSubFanOut) publish(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-p.publishQueue:
+			payload, err := json.Marshal(event)
+			if err != nil {
+				sentry.CaptureException(err)
+				log.Printf("Error encoding event for pub/sub: %v", err)
+				continue
+			}
+
+			if err := p.client.Publish(ctx, pubSubChannelPrefix+event.Token, payload).Err(); err != nil {
+				log.Printf("Error publishing event to pub/sub: %v", err)
+			}
+		}
+	}
+}
+
+// Run publishes queued events and forwards events published by any node for
+// the tokens subscribed to here until ctx is done. go-redis transparently
+// resubscribes if the connection to Redis drops.
+func (p *PubSubFanOut) Run(ctx context.Context) {
+	go p.publish(ctx)
+
+	sub := p.client.Subscribe(ctx)
+	defer sub.Close()
+
+	subscribed := make(map[string]bool)
+	p.resubscribe(ctx, sub, subscribed)
+
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.changed:
+			p.resubscribe(ctx, sub, subscribed)
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			var event PostHogEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				sentry.CaptureException(err)
+				log.Printf("Error decoding pub/sub event: %v", err)
+				continue
+			}
+
+			// With a pattern subscription as well as the token's own, Redis
+			// sends the event twice; the uuid drops the second copy.
+			if p.firstSighting(event.Uuid) {
+				p.outgoingChan <- event
+			}
+		}
+	}
+}
+
+// resubscribe subscribes sub to the channels of tokens that gained local
+// subscribers and unsubscribes it from those that lost them. subscribed holds
+// what sub is subscribed to and is updated to match. go-redis keeps track of a
+// subscription even when the command fails, and sends it again when it
+// reconnects, so failures are only logged.
+func (p *PubSubFanOut) resubscribe(ctx context.Context, sub *redis.PubSub, subscribed map[string]bool) {
+	p.mu.Lock()
+	wanted := make(map[string]bool, len(p.tokens))
+	for token := range p.tokens {
+		wanted[token] = true
+	}
+	p.mu.Unlock()
+
+	var add, remove []string
+	for token := range wanted {
+		if !subscribed[token] && token != "" {
+			add = append(add, pubSubChannelPrefix+token)
+		}
+	}
+	for token := range subscribed {
+		if !wanted[token] && token != "" {
+			remove = append(remove, pubSubChannelPrefix+token)
+		}
+	}
+
+	if len(add) > 0 {
+		if err := sub.Subscribe(ctx, add...); err != nil {
+			log.Printf("Error subscribing to pub/sub: %v", err)
+		}
+	}
+	if len(remove) > 0 {
+		if err := sub.Unsubscribe(ctx, remove...); err != nil {
+			log.Printf("Error unsubscribing from pub/sub: %v", err)
+		}
+	}
+	switch {
+	case wanted[""] && !subscribed[""]:
+		if err := sub.PSubscribe(ctx, pubSubChannelPrefix+"*"); err != nil {
+			log.Printf("Error subscribing to pub/sub: %v", err)
+		}
+	case !wanted[""] && subscribed[""]:
+		if err := sub.PUnsubscribe(ctx, pubSubChannelPrefix+"*"); err != nil {
+			log.Printf("Error unsubscribing from pub/sub: %v", err)
+		}
+	}
+
+	clear(subscribed)
+	for token := range wanted {
+		subscribed[token] = true
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestSeenUUIDs(t *testing.T) {
+	start := time.Now()
+	seen := newSeenUUIDs(time.Minute)
+	seen.rotatedAt = start
+
+	steps := []struct {
+		uuid  string
+		after time.Duration
+		want  bool
+	}{
+		{uuid: "a", after: 0, want: true},
+		{uuid: "a", after: time.Second, want: false},
+		// Still remembered from the previous window after a rotation.
+		{uuid: "b", after: 30 * time.Second, want: true},
+		{uuid: "a", after: 61 * time.Second, want: false},
+		{uuid: "b", after: 89 * time.Second, want: false},
+		// Forgotten two windows after it was last rotated in.
+		{uuid: "a", after: 122 * time.Second, want: true},
+		// Both windows are cleared after a long quiet spell.
+		{uuid: "a", after: 10 * time.Minute, want: true},
+	}
+
+	for _, step := range steps {
+		if got := seen.add(step.uuid, start.Add(step.after)); got != step.want {
+			t.Errorf("add(%q) after %v = %v, want %v", step.uuid, step.after, got, step.want)
+		}
+	}
+}
+
+func TestSeenUUIDsKeepsEveryUUIDWithinWindow(t *testing.T) {
+	now := time.Now()
+	seen := newSeenUUIDs(time.Minute)
+	for i := 0; i < 200000; i++ {
+		seen.add(strconv.Itoa(i), now)
+	}
+	if seen.add("0", now) {
+		t.Error("forgot a uuid seen within the window")
+	}
+}
+
+func TestPublishDeliversLocallyWhenQueueIsFull(t *testing.T) {
+	setConfig(t, "redis.pubsub.queue_size", 1)
+	outgoing := make(chan PostHogEvent, 10)
+	fanOut := NewPubSubFanOut(nil, outgoing)
+
+	for _, uuid := range []string{"a", "b", "a"} {
+		fanOut.Publish(PostHogEvent{Uuid: uuid, Token: "token"})
+	}
+
+	if got := len(outgoing); got != 2 {
+		t.Errorf("delivered %d events locally, want 2", got)
+	}
+	if got := len(fanOut.publishQueue); got != 1 {
+		t.Errorf("queued %d events for Redis, want 1", got)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPubSubSharesEventsBetweenNodes(t *testing.T) {
+	setConfig(t, "redis.pubsub.queue_size", 10)
+	server := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newNode := func() (*PubSubFanOut, chan PostHogEvent) {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { client.Close() })
+		outgoing := make(chan PostHogEvent, 10)
+		fanOut := NewPubSubFanOut(client, outgoing)
+		go fanOut.Run(ctx)
+		return fanOut, outgoing
+	}
+	nodeA, _ := newNode()
+	nodeB, received := newNode()
+
+	subscription := Subscription{Token: "token-a"}
+	nodeB.OnSubscribe(subscription)
+	channel := pubSubChannelPrefix + "token-a"
+	waitFor(t, "node B to subscribe to token-a", func() bool {
+		return server.PubSubNumSub(channel)[channel] == 1
+	})
+	if patterns := server.PubSubNumPat(); patterns != 0 {
+		t.Errorf("node B has %d pattern subscriptions, want it to subscribe to its token only", patterns)
+	}
+
+	nodeA.Publish(PostHogEvent{Uuid: "other", Token: "token-b"})
+	nodeA.Publish(PostHogEvent{Uuid: "wanted", Token: "token-a"})
+	select {
+	case event := <-received:
+		if event.Uuid != "wanted" {
+			t.Errorf("node B received %q, want only the event for its token", event.Uuid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("node B didn't receive the event node A published")
+	}
+
+	nodeB.OnUnsubscribe(subscription)
+	waitFor(t, "node B to unsubscribe from token-a", func() bool {
+		return server.PubSubNumSub(channel)[channel] == 0
+	})
+
+	// A stream that isn't scoped to a token needs every token's events.
+	nodeB.OnSubscribe(Subscription{Geo: true})
+	waitFor(t, "node B to pattern-subscribe", func() bool {
+		return server.PubSubNumPat() == 1
+	})
+	nodeA.Publish(PostHogEvent{Uuid: "any", Token: "token-c"})
+	select {
+	case event := <-received:
+		if event.Uuid != "any" {
+			t.Errorf("node B received %q, want the event for token-c", event.Uuid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("node B didn't receive an event through its pattern subscription")
+	}
+}
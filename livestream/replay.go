@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+)
+
+// ReplayMode controls what a new subscriber receives before live events.
+type ReplayMode string
+
+const (
+	// ReplayNone only streams events that arrive after the client connected.
+	ReplayNone ReplayMode = "none"
+	// ReplayBuffer first sends everything in the token's replay buffer.
+	ReplayBuffer ReplayMode = "buffer"
+	// ReplayLastEventID sends the buffered events newer than the client's
+	// Last-Event-ID header.
+	ReplayLastEventID ReplayMode = "lastEventId"
+)
+
+func parseReplayMode(mode string) (ReplayMode, error) {
+	switch ReplayMode(mode) {
+	case "", ReplayNone:
+		return ReplayNone, nil
+	case ReplayBuffer, ReplayLastEventID:
+		return ReplayMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown replay mode %q", mode)
+	}
+}
+
+// replayBuffer is a fixed-size ring of the most recent events for a token.
+type replayBuffer struct {
+	events []PostHogEvent
+	added  []time.Time
+	sizes  []int
+	bytes  int
+	next   int
+	full   bool
+
+	// active is when the token last had an event or a replay.
+	active time.Time
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{
+		events: make([]PostHogEvent, size),
+		added:  make([]time.Time, size),
+		sizes:  make([]int, size),
+	}
+}
+
+// add stores event, overwriting the oldest one once the ring is full, and
+// returns the change in the buffer's estimated size.
+func (b *replayBuffer) add(event PostHogEvent) int {
+	if len(b.events) == 0 {
+		return 0
+	}
+	size := estimateEventSize(event)
+	delta := size - b.sizes[b.next]
+	b.events[b.next] = event
+	b.added[b.next] = time.Now()
+	b.sizes[b.next] = size
+	b.bytes += delta
+	b.next = (b.next + 1) % len(b.events)
+	if b.next == 0 {
+		b.full = true
+	}
+	return delta
+}
+
+// slots returns the indexes of the buffered events from oldest to newest.
+func (b *replayBuffer) slots() []int {
+	start, count := 0, b.next
+	if b.full {
+		start, count = b.next, len(b.events)
+	}
+	slots := make([]int, count)
+	for i := range slots {
+		slots[i] = (start + i) % len(b.events)
+	}
+	return slots
+}
+
+// all returns the buffered events added after notBefore, from oldest to
+// newest. A zero notBefore returns every buffered event.
+func (b *replayBuffer) all(notBefore time.Time) []PostHogEvent {
+	events, _ := b.since("", notBefore)
+	return events
+}
+
+// since returns the buffered events that came after the event with the given
+// ID, leaving out any added before notBefore. The ID is a sequence ID or a
+// UUID. complete is false if events after it may be missing, either because
+// it is no longer buffered (every remaining event is returned) or because
+// some were too old.
+func (b *replayBuffer) since(id string, notBefore time.Time) (events []PostHogEvent, complete bool) {
+	slots := b.slots()
+	complete = id == ""
+	if generation, seq, ok := parseSequenceID(id); ok {
+		slots, complete = b.afterSequence(slots, generation, seq)
+	} else {
+		for i := len(slots) - 1; i >= 0 && id != ""; i-- {
+			if b.events[slots[i]].Uuid == id {
+				slots = slots[i+1:]
+				complete = true
+				break
+			}
+		}
+	}
+
+	for _, slot := range slots {
+		if b.added[slot].Before(notBefore) {
+			complete = false
+			continue
+		}
+		events = append(events, b.events[slot])
+	}
+	return events, complete
+}
+
+// afterSequence narrows slots to the events numbered after seq. Sequence
+// numbers are consecutive, so nothing is missing if the first of them follows
+// seq directly. A sequence from another generation can't be compared, so
+// every slot is kept and the replay is incomplete.
+func (b *replayBuffer) afterSequence(slots []int, generation string, seq uint64) ([]int, bool) {
+	if generation != sequenceGeneration {
+		return slots, false
+	}
+	for i, slot := range slots {
+		if b.events[slot].Seq > seq {
+			return slots[i:], b.events[slot].Seq == seq+1
+		}
+	}
+	return nil, true
+}
+
+// ReplayGap is sent ahead of a Last-Event-ID backfill when some of the events
+// the client missed are no longer available, so it knows it skipped some.
+type ReplayGap struct {
+	LastEventID string `json:"last_event_id"`
+}
+
+// replayBuffers holds the replay buffer of every token. It keeps at most
+// maxTokens buffers with a combined estimated size within maxBytes by dropping
+// the buffers of the tokens that were least recently active, and drops a
+// buffer once its token has been idle for idleTTL. A limit of 0 means none.
+// It is only used from Filter.Run, so it needs no locking.
+type replayBuffers struct {
+	size     int
+	maxBytes int
+	idleTTL  time.Duration
+	bytes    int
+	buffers  *simplelru.LRU[string, *replayBuffer]
+}
+
+func newReplayBuffers(size int, maxTokens int, maxBytes int, idleTTL time.Duration) *replayBuffers {
+	if maxTokens <= 0 {
+		maxTokens = math.MaxInt
+	}
+	b := &replayBuffers{size: size, maxBytes: maxBytes, idleTTL: idleTTL}
+	b.buffers, _ = simplelru.NewLRU(maxTokens, func(_ string, buffer *replayBuffer) {
+		b.bytes -= buffer.bytes
+	})
+	return b
+}
+
+// get returns the buffer for token and marks the token as active.
+func (b *replayBuffers) get(token string, now time.Time) (*replayBuffer, bool) {
+	b.expire(now)
+	buffer, ok := b.buffers.Get(token)
+	if ok {
+		buffer.active = now
+	}
+	return buffer, ok
+}
+
+// expire drops the buffers of tokens that have been idle for idleTTL. The
+// least recently active token is always the oldest entry, so it stops at the
+// first that is still active.
+func (b *replayBuffers) expire(now time.Time) {
+	for b.idleTTL > 0 {
+		_, oldest, ok := b.buffers.GetOldest()
+		if !ok || now.Sub(oldest.active) < b.idleTTL {
+			return
+		}
+		b.buffers.RemoveOldest()
+	}
+}
+
+// add records event in its token's buffer, then evicts other tokens' buffers
+// until the budget is met again.
+func (b *replayBuffers) add(event PostHogEvent, now time.Time) {
+	b.expire(now)
+	buffer, ok := b.buffers.Get(event.Token)
+	if !ok {
+		buffer = newReplayBuffer(b.size)
+		b.buffers.Add(event.Token, buffer)
+	}
+	buffer.active = now
+	b.bytes += buffer.add(event)
+
+	// The buffer just written to is the most recently active, so it is only
+	// ever evicted last and is kept even if it alone exceeds the budget.
+	for b.maxBytes > 0 && b.bytes > b.maxBytes && b.buffers.Len() > 1 {
+		b.buffers.RemoveOldest()
+	}
+}
+
+// estimateEventSize approximates the memory an event holds: its strings plus
+// a rough cost for every property.
+func estimateEventSize(event PostHogEvent) int {
+	size := 64 + len(event.Uuid) + len(event.Timestamp) + len(event.DistinctId) + len(event.Event) + len(event.Token)
+	return size + estimateValueSize(event.Properties)
+}
+
+func estimateValueSize(value interface{}) int {
+	switch v := value.(type) {
+	case string:
+		return 16 + len(v)
+	case map[string]interface{}:
+		size := 48
+		for key, item := range v {
+			size += 16 + len(key) + estimateValueSize(item)
+		}
+		return size
+	case []interface{}:
+		size := 24
+		for _, item := range v {
+			size += estimateValueSize(item)
+		}
+		return size
+	default:
+		return 16
+	}
+}
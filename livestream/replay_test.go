@@ -0,0 +1,289 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// replayed subscribes sub after events have been through the filter and
+// returns what it was sent before any live event: event UUIDs, and "gap" for
+// a ReplayGap.
+func replayed(t *testing.T, events []PostHogEvent, sub Subscription) []string {
+	t.Helper()
+	filter, _ := newTestFilter(t)
+	for _, event := range events {
+		filter.inboundChan <- event
+	}
+
+	filter.Subscribe(sub)
+	// Run handles one request at a time, so once it has taken the
+	// unsubscribe it is done replaying.
+	filter.Unsubscribe(sub)
+
+	var got []string
+	for len(sub.EventChan) > 0 {
+		switch payload := (<-sub.EventChan).(type) {
+		case ResponsePostHogEvent:
+			got = append(got, payload.Uuid)
+		case ReplayGap:
+			got = append(got, "gap")
+		}
+	}
+	return got
+}
+
+func testEvents(uuids ...string) []PostHogEvent {
+	events := make([]PostHogEvent, len(uuids))
+	for i, uuid := range uuids {
+		events[i] = PostHogEvent{Token: "token", Event: "$pageview", Uuid: uuid}
+	}
+	return events
+}
+
+func TestReplayModes(t *testing.T) {
+	setConfig(t, "replay.buffer_size", 3)
+
+	tests := []struct {
+		name        string
+		replay      ReplayMode
+		lastEventID string
+		token       string
+		want        []string
+	}{
+		{name: "none", replay: ReplayNone},
+		{name: "buffer", replay: ReplayBuffer, want: []string{"2", "3", "4"}},
+		{name: "buffer for another token", replay: ReplayBuffer, token: "other"},
+		{name: "lastEventId", replay: ReplayLastEventID, lastEventID: "3", want: []string{"4"}},
+		{name: "lastEventId is the newest event", replay: ReplayLastEventID, lastEventID: "4"},
+		{name: "lastEventId without the header", replay: ReplayLastEventID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := "token"
+			if tt.token != "" {
+				token = tt.token
+			}
+			sub := newTestSubscription("a", token)
+			sub.Replay = tt.replay
+			sub.LastEventID = tt.lastEventID
+
+			if got := replayed(t, testEvents("1", "2", "3", "4"), sub); !slices.Equal(got, tt.want) {
+				t.Errorf("replayed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReplayMode(t *testing.T) {
+	for mode, want := range map[string]ReplayMode{
+		"":            ReplayNone,
+		"none":        ReplayNone,
+		"buffer":      ReplayBuffer,
+		"lastEventId": ReplayLastEventID,
+	} {
+		if got, err := parseReplayMode(mode); err != nil || got != want {
+			t.Errorf("parseReplayMode(%q) = %q, %v, want %q", mode, got, err, want)
+		}
+	}
+	if _, err := parseReplayMode("all"); err == nil {
+		t.Error("parseReplayMode accepted an unknown mode")
+	}
+}
+
+func TestLastEventIDBackfill(t *testing.T) {
+	setConfig(t, "replay.buffer_size", 3)
+
+	tests := []struct {
+		name        string
+		lastEventID string
+		sequenceIDs bool
+		maxAge      time.Duration
+		want        []string
+	}{
+		{name: "in range", lastEventID: "2", want: []string{"3", "4"}},
+		{name: "no longer buffered", lastEventID: "1", want: []string{"gap", "2", "3", "4"}},
+		{name: "unknown", lastEventID: "9", want: []string{"gap", "2", "3", "4"}},
+		{name: "older than replay.max_age", lastEventID: "2", maxAge: time.Nanosecond, want: []string{"gap"}},
+		{name: "sequence ID in range", lastEventID: formatSequenceID(2), sequenceIDs: true, want: []string{"3", "4"}},
+		{name: "sequence ID no longer buffered", lastEventID: formatSequenceID(0), sequenceIDs: true, want: []string{"gap", "2", "3", "4"}},
+		{name: "sequence ID from before a restart", lastEventID: "0-2", sequenceIDs: true, want: []string{"gap", "2", "3", "4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, "replay.sequence_ids", tt.sequenceIDs)
+			setConfig(t, "replay.max_age", tt.maxAge)
+
+			sub := newTestSubscription("a", "token")
+			sub.Replay = ReplayLastEventID
+			sub.LastEventID = tt.lastEventID
+
+			if got := replayed(t, testEvents("1", "2", "3", "4"), sub); !slices.Equal(got, tt.want) {
+				t.Errorf("replayed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayBuffersEvictTokens(t *testing.T) {
+	start := time.Now()
+	event := func(token string) PostHogEvent {
+		return PostHogEvent{Token: token, Event: "$pageview", Uuid: "1"}
+	}
+
+	tests := []struct {
+		name      string
+		maxTokens int
+		idleTTL   time.Duration
+		steps     func(b *replayBuffers)
+		want      []string
+	}{
+		{
+			name:      "least recently active token over max_tokens",
+			maxTokens: 2,
+			steps: func(b *replayBuffers) {
+				b.add(event("a"), start)
+				b.add(event("b"), start)
+				b.get("a", start)
+				b.add(event("c"), start)
+			},
+			want: []string{"a", "c"},
+		},
+		{
+			name:    "idle tokens expire",
+			idleTTL: time.Minute,
+			steps: func(b *replayBuffers) {
+				b.add(event("a"), start)
+				b.add(event("b"), start.Add(30*time.Second))
+				b.add(event("c"), start.Add(70*time.Second))
+			},
+			want: []string{"b", "c"},
+		},
+		{
+			name:    "a replay keeps a token active",
+			idleTTL: time.Minute,
+			steps: func(b *replayBuffers) {
+				b.add(event("a"), start)
+				b.add(event("b"), start)
+				b.get("a", start.Add(50*time.Second))
+				b.get("c", start.Add(70*time.Second))
+			},
+			want: []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newReplayBuffers(3, tt.maxTokens, 0, tt.idleTTL)
+			tt.steps(b)
+			got := b.buffers.Keys()
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("buffered tokens %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayBuffersMaxBytes(t *testing.T) {
+	event := func(token string, uuid string) PostHogEvent {
+		return PostHogEvent{Token: token, Event: "$pageview", Uuid: uuid}
+	}
+	size := estimateEventSize(event("a", "1"))
+	now := time.Now()
+
+	// Room for three events across all tokens.
+	b := newReplayBuffers(2, 0, 3*size, 0)
+	b.add(event("a", "1"), now)
+	b.add(event("b", "1"), now)
+	b.add(event("a", "2"), now)
+	if got := b.buffers.Len(); got != 2 {
+		t.Fatalf("buffered %d tokens within the budget, want 2", got)
+	}
+
+	// The fourth event goes over, so the least recently active token goes.
+	b.add(event("c", "1"), now)
+	got := b.buffers.Keys()
+	slices.Sort(got)
+	if want := []string{"a", "c"}; !slices.Equal(got, want) {
+		t.Errorf("buffered tokens %v, want %v", got, want)
+	}
+	if b.bytes != 3*size {
+		t.Errorf("tracked %d bytes, want %d", b.bytes, 3*size)
+	}
+
+	// Overwriting a full ring doesn't grow it.
+	b.add(event("a", "3"), now)
+	if b.bytes != 3*size {
+		t.Errorf("tracked %d bytes after overwriting, want %d", b.bytes, 3*size)
+	}
+}
+
+func TestReplayMaxBytesDefault(t *testing.T) {
+	config, err := loadTestConfig(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Replay.MaxBytes <= 0 {
+		t.Errorf("replay.max_bytes defaults to %d, want a limit", config.Replay.MaxBytes)
+	}
+}
+
+func TestSequenceIDs(t *testing.T) {
+	setConfig(t, "replay.sequence_ids", true)
+	setConfig(t, "replay.buffer_size", 3)
+
+	t.Run("monotonic per token", func(t *testing.T) {
+		filter, _ := newTestFilter(t)
+		subs := map[string]Subscription{"token": newTestSubscription("a", "token"), "other": newTestSubscription("b", "other")}
+		for _, sub := range subs {
+			filter.Subscribe(sub)
+		}
+		for _, token := range []string{"token", "other", "token", "token", "other"} {
+			filter.inboundChan <- PostHogEvent{Token: token, Event: "$pageview"}
+		}
+
+		for token, want := range map[string]int{"token": 3, "other": 2} {
+			for seq := 1; seq <= want; seq++ {
+				var id string
+				select {
+				case payload := <-subs[token].EventChan:
+					id = payload.(ResponsePostHogEvent).ID
+				case <-time.After(time.Second):
+					t.Fatalf("%s's event %d wasn't delivered", token, seq)
+				}
+				generation, got, ok := parseSequenceID(id)
+				if !ok || generation != sequenceGeneration || got != uint64(seq) {
+					t.Errorf("%s's event %d has ID %q, want sequence %d of this generation", token, seq, id, seq)
+				}
+			}
+		}
+	})
+
+	// Events 1 to 4 are numbered 1 to 4; the buffer keeps 2 to 4.
+	tests := []struct {
+		name        string
+		lastEventID string
+		want        []string
+	}{
+		{name: "buffered", lastEventID: formatSequenceID(2), want: []string{"3", "4"}},
+		{name: "just before the buffer", lastEventID: formatSequenceID(1), want: []string{"2", "3", "4"}},
+		{name: "older than the buffer", lastEventID: formatSequenceID(0), want: []string{"gap", "2", "3", "4"}},
+		{name: "newest", lastEventID: formatSequenceID(4)},
+		{name: "before a restart", lastEventID: "0-2", want: []string{"gap", "2", "3", "4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := newTestSubscription("a", "token")
+			sub.Replay = ReplayLastEventID
+			sub.LastEventID = tt.lastEventID
+
+			if got := replayed(t, testEvents("1", "2", "3", "4"), sub); !slices.Equal(got, tt.want) {
+				t.Errorf("replayed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With replay.sequence_ids, events get compact IDs that order them instead of
+// their UUIDs: a per-token sequence number, prefixed with the generation of
+// the process that assigned it. Sequences start over on restart; the new
+// generation tells a resuming client's Last-Event-ID apart from the current
+// sequence, so it gets a gap rather than the wrong events.
+var sequenceGeneration = strconv.FormatInt(time.Now().UnixMilli(), 36)
+
+// formatSequenceID returns the event ID for seq in this generation.
+func formatSequenceID(seq uint64) string {
+	return sequenceGeneration + "-" + strconv.FormatUint(seq, 36)
+}
+
+// parseSequenceID splits an ID made by formatSequenceID. ok is false for
+// anything else, such as an event UUID.
+func parseSequenceID(id string) (generation string, seq uint64, ok bool) {
+	generation, encoded, found := strings.Cut(id, "-")
+	if !found || generation == "" || strings.Contains(encoded, "-") {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(encoded, 36, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return generation, seq, true
+}
+
+// sequenceID returns the event's ID in this generation, or "" if it has no
+// sequence number.
+func (e PostHogEvent) sequenceID() string {
+	if e.Seq == 0 {
+		return ""
+	}
+	return formatSequenceID(e.Seq)
+}
+
+// sequences hands out the next sequence number per token. Numbers start at 1,
+// so 0 means an event has none. It is only used from Filter.Run.
+type sequences map[string]uint64
+
+func (s sequences) next(token string) uint64 {
+	s[token]++
+	return s[token]
+}
@@ -0,0 +1,48 @@
+package main
+
+// EventTransform rewrites an event before it is sent to a subscriber. It runs
+// after the subscriber's filters have matched the event as ingested.
+// Transforms must not modify the event they're given in place (in particular
+// its Properties map, which is shared with the stats keeper); they should
+// return a modified copy instead.
+type EventTransform func(PostHogEvent) PostHogEvent
+
+// transformsFromConfig builds the transforms enabled in the config, in the
+// order they should run.
+func transformsFromConfig() []EventTransform {
+	var transforms []EventTransform
+
+	allow := conf.Transforms.Redact.Allowlist
+	block := conf.Transforms.Redact.Blocklist
+	if len(allow) > 0 || len(block) > 0 {
+		transforms = append(transforms, redactProperties(allow, block))
+	}
+
+	return transforms
+}
+
+// redactProperties strips properties before events reach clients, e.g. to
+// keep PII out of browsers. If allow is non-empty only those properties are
+// kept; any property in block is always removed.
+func redactProperties(allow []string, block []string) EventTransform {
+	allowed := make(map[string]bool, len(allow))
+	for _, key := range allow {
+		allowed[key] = true
+	}
+	blocked := make(map[string]bool, len(block))
+	for _, key := range block {
+		blocked[key] = true
+	}
+
+	return func(event PostHogEvent) PostHogEvent {
+		properties := make(map[string]interface{}, len(event.Properties))
+		for key, value := range event.Properties {
+			if blocked[key] || (len(allowed) > 0 && !allowed[key]) {
+				continue
+			}
+			properties[key] = value
+		}
+		event.Properties = properties
+		return event
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// WebhookSink forwards the events matching its subscription to an HTTP
+// endpoint in batches. It is subscribed to the filter like any SSE client, so
+// a slow or failing endpoint only ever drops its own events.
+type WebhookSink struct {
+	url          string
+	subscription Subscription
+	client       *http.Client
+
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	retryBackoff  time.Duration
+}
+
+// webhookSinksFromConfig builds the sinks listed in webhook.sinks. Each entry
+// has a token and url, and optionally event_types, distinct_id and
+// properties (a JSON property filter, as accepted by /events).
+func webhookSinksFromConfig() ([]*WebhookSink, error) {
+	sinks := make([]*WebhookSink, 0, len(conf.Webhook.Sinks))
+	for i, entry := range conf.Webhook.Sinks {
+		if entry.Token == "" || entry.URL == "" {
+			return nil, fmt.Errorf("webhook.sinks[%d]: token and url must be set", i)
+		}
+		properties, err := parsePropertyFilters(entry.Properties)
+		if err != nil {
+			return nil, fmt.Errorf("webhook.sinks[%d]: %w", i, err)
+		}
+
+		sinks = append(sinks, &WebhookSink{
+			url: entry.URL,
+			subscription: Subscription{
+				ClientId:    newSubscriptionID(),
+				Token:       entry.Token,
+				DistinctId:  entry.DistinctId,
+				EventTypes:  entry.EventTypes,
+				Properties:  properties,
+				EventChan:   make(chan interface{}, conf.Webhook.BufferSize),
+				ShouldClose: &atomic.Bool{},
+				Dropped:     &atomic.Int64{},
+				Revoked:     make(chan struct{}),
+			},
+			client:        &http.Client{Timeout: conf.Webhook.Timeout},
+			batchSize:     conf.Webhook.BatchSize,
+			flushInterval: conf.Webhook.FlushInterval,
+			maxRetries:    conf.Webhook.MaxRetries,
+			retryBackoff:  conf.Webhook.RetryBackoff,
+		})
+	}
+	return sinks, nil
+}
+
+// startWebhookSinks subscribes every sink to filter and starts it. The
+// returned stage stops the sinks after flushing what they hold; it is meant
+// for Lifecycle.Shutdown. Deliveries still running when the stage's ctx is
+// done, retries included, are given up on.
+func startWebhookSinks(filter *Filter, sinks []*WebhookSink) func(context.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, sink := range sinks {
+		if !filter.Subscribe(sink.subscription) {
+			continue
+		}
+		wg.Add(1)
+		go func(sink *WebhookSink) {
+			defer wg.Done()
+			sink.Run(ctx, stop)
+		}(sink)
+	}
+
+	return func(shutdownCtx context.Context) error {
+		defer cancel()
+		context.AfterFunc(shutdownCtx, cancel)
+		close(stop)
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-shutdownCtx.Done():
+			return shutdownCtx.Err()
+		}
+	}
+}
+
+// Run batches events until stop is closed, posting a batch whenever it
+// reaches batchSize or flushInterval has passed since its first event. Once
+// stop is closed, the events it holds are posted before Run returns. Posts are
+// abandoned when ctx is done.
+func (s *WebhookSink) Run(ctx context.Context, stop <-chan struct{}) {
+	batch := make([]interface{}, 0, s.batchSize)
+	flushTimer := time.NewTimer(s.flushInterval)
+	flushTimer.Stop()
+
+	flush := func() {
+		flushTimer.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		s.deliver(ctx, batch)
+		batch = make([]interface{}, 0, s.batchSize)
+	}
+
+	for {
+		select {
+		case <-stop:
+			// Events already queued for the sink are flushed too.
+			for n := len(s.subscription.EventChan); n > 0; n-- {
+				batch = append(batch, <-s.subscription.EventChan)
+				if len(batch) >= s.batchSize {
+					flush()
+				}
+			}
+			flush()
+			return
+		case <-s.subscription.Revoked:
+			log.Printf("Token revoked, stopping webhook %s", s.url)
+			return
+		case <-flushTimer.C:
+			flush()
+		case event := <-s.subscription.EventChan:
+			if len(batch) == 0 {
+				flushTimer.Reset(s.flushInterval)
+			}
+			batch = append(batch, event)
+			if len(batch) >= s.batchSize {
+				flush()
+			}
+		}
+	}
+}
+
+// deliver posts batch, retrying network errors and 5xx responses with
+// exponential backoff. Batches that can't be delivered are dead-lettered.
+func (s *WebhookSink) deliver(ctx context.Context, batch []interface{}) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		sentry.CaptureException(err)
+		WebhookEventsDeadLettered.Add(float64(len(batch)))
+		return
+	}
+
+	backoff := s.retryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(ctx, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= s.maxRetries || ctx.Err() != nil {
+			log.Printf("Dropping %d events for webhook %s: %v", len(batch), s.url, err)
+			WebhookEventsDeadLettered.Add(float64(len(batch)))
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+		}
+	}
+}
+
+// post sends one request and reports whether a failure is worth retrying.
+func (s *WebhookSink) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return false, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// webhookServer records the batches posted to it. Its handler answers each
+// request with the next of statuses, then with 200 once they run out.
+type webhookServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	batches  [][]string
+	posted   chan struct{}
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	ws := &webhookServer{statuses: statuses, posted: make(chan struct{}, 10)}
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []string
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("webhook body isn't a JSON array of events: %v", err)
+		}
+
+		ws.mu.Lock()
+		status := http.StatusOK
+		if len(ws.statuses) > 0 {
+			status, ws.statuses = ws.statuses[0], ws.statuses[1:]
+		}
+		if status < 300 {
+			ws.batches = append(ws.batches, batch)
+		}
+		ws.mu.Unlock()
+
+		w.WriteHeader(status)
+		ws.posted <- struct{}{}
+	}))
+	t.Cleanup(ws.Close)
+	return ws
+}
+
+func (ws *webhookServer) waitForPost(t *testing.T) {
+	t.Helper()
+	select {
+	case <-ws.posted:
+	case <-time.After(time.Second):
+		t.Fatal("webhook wasn't posted to")
+	}
+}
+
+func (ws *webhookServer) delivered() [][]string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.batches
+}
+
+func newTestWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		url:           url,
+		subscription:  newTestSubscription("webhook", "token"),
+		client:        &http.Client{Timeout: time.Second},
+		batchSize:     2,
+		flushInterval: time.Hour,
+		maxRetries:    2,
+		retryBackoff:  time.Millisecond,
+	}
+}
+
+func TestWebhookSinkBatches(t *testing.T) {
+	server := newWebhookServer(t)
+	sink := newTestWebhookSink(server.URL)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		sink.Run(context.Background(), stop)
+		close(done)
+	}()
+
+	for _, event := range []string{"a", "b", "c"} {
+		sink.subscription.EventChan <- event
+	}
+	server.waitForPost(t)
+
+	// The event still queued is flushed on the way out.
+	close(stop)
+	<-done
+
+	got := server.delivered()
+	if len(got) != 2 || len(got[0]) != 2 || len(got[1]) != 1 || got[1][0] != "c" {
+		t.Errorf("webhook received %v, want [[a b] [c]]", got)
+	}
+}
+
+func TestWebhookSinkFlushesAfterInterval(t *testing.T) {
+	server := newWebhookServer(t)
+	sink := newTestWebhookSink(server.URL)
+	sink.flushInterval = 10 * time.Millisecond
+	stop := make(chan struct{})
+	defer close(stop)
+	go sink.Run(context.Background(), stop)
+
+	sink.subscription.EventChan <- "a"
+	server.waitForPost(t)
+	if got := server.delivered(); len(got) != 1 || len(got[0]) != 1 {
+		t.Errorf("webhook received %v, want [[a]] once the interval passed", got)
+	}
+}
+
+func TestWebhookSinkRetries(t *testing.T) {
+	tests := []struct {
+		name           string
+		statuses       []int
+		wantPosts      int
+		wantDelivered  bool
+		wantDeadLetter float64
+	}{
+		{name: "5xx then success", statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway}, wantPosts: 3, wantDelivered: true},
+		{name: "5xx until retries run out", statuses: []int{500, 500, 500}, wantPosts: 3, wantDeadLetter: 2},
+		{name: "4xx isn't retried", statuses: []int{http.StatusBadRequest}, wantPosts: 1, wantDeadLetter: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newWebhookServer(t, tt.statuses...)
+			sink := newTestWebhookSink(server.URL)
+			deadLettered := testutil.ToFloat64(WebhookEventsDeadLettered)
+
+			sink.deliver(context.Background(), []interface{}{"a", "b"})
+
+			if got := len(server.posted); got != tt.wantPosts {
+				t.Errorf("webhook was posted to %d times, want %d", got, tt.wantPosts)
+			}
+			if got := len(server.delivered()) == 1; got != tt.wantDelivered {
+				t.Errorf("batch delivered = %v, want %v", got, tt.wantDelivered)
+			}
+			if got := testutil.ToFloat64(WebhookEventsDeadLettered) - deadLettered; got != tt.wantDeadLetter {
+				t.Errorf("dead-lettered %v events, want %v", got, tt.wantDeadLetter)
+			}
+		})
+	}
+}
+
+func TestWebhookShutdownIsBoundedByContext(t *testing.T) {
+	server := newWebhookServer(t, 500, 500, 500)
+	sink := newTestWebhookSink(server.URL)
+	sink.batchSize = 1
+	sink.retryBackoff = time.Hour
+
+	filter, _ := newTestFilter(t)
+	stopSinks := startWebhookSinks(filter, []*WebhookSink{sink})
+	sink.subscription.EventChan <- "a"
+	// The sink is now waiting an hour to retry.
+	server.waitForPost(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	stopSinks(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stopping the sinks took %v, want it bounded by the shutdown context", elapsed)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: checkWebSocketOrigin,
+}
+
+// checkWebSocketOrigin decides which pages may open a WebSocket. Unlike a
+// fetch to /events, the handshake isn't covered by CORS and browsers attach
+// cookies to it, so with jwt.cookie_name set any site could otherwise open a
+// stream as its visitor. Same-origin pages and those on
+// websocket.allowed_origins may connect; clients that send no Origin aren't
+// browsers and always can.
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return slices.Contains(conf.WebSocket.AllowedOrigins, origin)
+}
+
+// wsControlMessage is sent by WebSocket clients to steer their subscription.
+//
+//	{"type": "update", "eventTypes": ["$pageview"], "properties": [...]}
+//	{"type": "ack", "event_id": "<uuid>"}
+//	{"type": "pause"} / {"type": "resume"}
+type wsControlMessage struct {
+	Type        string          `json:"type"`
+	EventTypes  []string        `json:"eventTypes,omitempty"`
+	DistinctIDs []string        `json:"distinctIds,omitempty"`
+	Properties  json.RawMessage `json:"properties,omitempty"`
+	EventID     string          `json:"event_id,omitempty"`
+}
+
+// wsMessage is sent to WebSocket clients.
+type wsMessage struct {
+	Type  string      `json:"type"`
+	ID    string      `json:"id,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// withFilters returns a copy of sub with its event filters replaced. The
+// token, channels and client ID are kept so the filter sees the same client.
+func (sub Subscription) withFilters(msg wsControlMessage) (Subscription, error) {
+	properties, err := parsePropertyFilters(string(msg.Properties))
+	if err != nil {
+		return sub, err
+	}
+
+	sub.EventTypes = msg.EventTypes
+	sub.DistinctIDs = msg.DistinctIDs
+	sub.Properties = properties
+	return sub, nil
+}
+
+// WebSocketHandler serves the same subscriptions as /events over a WebSocket,
+// which lets clients change their filters or ack events without reconnecting.
+func WebSocketHandler(filter *Filter, lifecycle *Lifecycle, acks *AckRegistry) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if remaining, starting := lifecycle.Starting(); starting {
+			setRetryAfter(c, remaining)
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "starting")
+		}
+
+		if err := checkAuthBackoff(c); err != nil {
+			return err
+		}
+
+		exited, ok := lifecycle.Track()
+		if !ok {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "shutting down")
+		}
+		defer exited()
+
+		release, err := acquireConnection(c)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		subscription, err := subscriptionFromRequest(c)
+		if err != nil {
+			var authErr *authError
+			if errors.As(err, &authErr) {
+				recordAuthResult(c, true)
+				return echo.NewHTTPError(http.StatusUnauthorized, authErr.Error())
+			}
+			return err
+		}
+		// Geo streams don't authenticate, so they say nothing about whether
+		// this IP's tokens work and mustn't clear its backoff.
+		if !subscription.Geo {
+			recordAuthResult(c, false)
+		}
+
+		conn, err := upgrader.Upgrade(c.Response(), c.Request(), http.Header{HeaderSubscriptionID: {subscription.ClientId}})
+		if err != nil {
+			// The upgrader has already replied to the client.
+			c.Logger().Printf("WebSocket upgrade failed: %v", err)
+			return nil
+		}
+		defer conn.Close()
+		if limit := conf.Server.MaxBodyBytes; limit > 0 {
+			conn.SetReadLimit(limit)
+		}
+		if accessLogs.sample() {
+			c.Logger().Printf("WebSocket client connected, ip: %v", c.RealIP())
+		}
+
+		if !filter.Subscribe(subscription) {
+			return nil
+		}
+		defer func() {
+			filter.Unsubscribe(subscription)
+			subscription.ShouldClose.Store(true)
+		}()
+
+		var unacked *ackBuffer
+		var redeliver []interface{}
+		if ack := c.QueryParam("ack"); strings.ToLower(ack) == "true" || ack == "1" {
+			unacked, redeliver = acks.open(subscription.ClientId, subscription.Token, c.QueryParam("resume"))
+			defer acks.close(subscription.ClientId)
+		}
+
+		send := func(payload interface{}) error {
+			msg := wsMessage{Type: "event", Data: payload}
+			if _, ok := payload.(ReplayGap); ok {
+				msg.Type = "gap"
+			}
+			if phEvent, ok := payload.(ResponsePostHogEvent); ok {
+				msg.ID = phEvent.eventID()
+			}
+			if err := conn.WriteJSON(msg); err != nil {
+				return err
+			}
+			if unacked != nil && msg.ID != "" {
+				unacked.add(msg.ID, payload)
+			}
+			return nil
+		}
+
+		paused := newPauseBuffer(subscription.Dropped)
+
+		for _, payload := range redeliver {
+			if err := send(payload); err != nil {
+				return nil
+			}
+		}
+
+		// Gorilla connections support one concurrent reader, so control
+		// messages are read on their own goroutine and handed to the loop.
+		done := make(chan struct{})
+		defer close(done)
+		controls := make(chan wsControlMessage)
+		readErr := make(chan error, 1)
+		go func() {
+			for {
+				var msg wsControlMessage
+				if err := conn.ReadJSON(&msg); err != nil {
+					readErr <- err
+					return
+				}
+				select {
+				case controls <- msg:
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		drain := lifecycle.Drain()
+		var drainClose <-chan time.Time
+		closeReason := "draining"
+
+		for {
+			select {
+			case <-drain:
+				// Stop watching Drain and close after a random delay instead.
+				drain = nil
+				drainClose = time.After(lifecycle.DrainDelay())
+			case delay := <-subscription.Reconnect:
+				drain = nil
+				drainClose = time.After(delay)
+				closeReason = "reconnect"
+			case <-subscription.Overflowed:
+				conn.WriteJSON(wsMessage{Type: "overflow"})
+				closeMsg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "fell behind")
+				conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+				return nil
+			case <-subscription.Revoked:
+				conn.WriteJSON(wsMessage{Type: "revoked"})
+				closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token revoked")
+				conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+				return nil
+			case <-drainClose:
+				if closeReason == "reconnect" {
+					conn.WriteJSON(wsMessage{Type: "reconnect"})
+				}
+				closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, closeReason)
+				conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+				return nil
+			case err := <-readErr:
+				var syntaxErr *json.SyntaxError
+				if errors.As(err, &syntaxErr) {
+					conn.WriteJSON(wsMessage{Type: "error", Error: "invalid control message"})
+				}
+				if errors.Is(err, websocket.ErrReadLimit) {
+					RejectedRequests.WithLabelValues("body_too_large").Inc()
+				}
+				if accessLogs.disconnect(subscription) {
+					c.Logger().Printf("WebSocket client disconnected, ip: %v, dropped: %d", c.RealIP(), subscription.Dropped.Load())
+				}
+				return nil
+			case msg := <-controls:
+				switch msg.Type {
+				case "update":
+					updated, err := subscription.withFilters(msg)
+					if err != nil {
+						conn.WriteJSON(wsMessage{Type: "error", Error: err.Error()})
+						continue
+					}
+					subscription = updated
+					if !filter.Update(subscription) {
+						return nil
+					}
+				case signalPause:
+					paused.pause()
+				case signalResume:
+					for _, payload := range paused.resume() {
+						if err := send(payload); err != nil {
+							return nil
+						}
+					}
+				case "ack":
+					if !acks.Ack(subscription.ClientId, subscription.Token, msg.EventID) {
+						conn.WriteJSON(wsMessage{Type: "error", Error: "unknown event"})
+					}
+				default:
+					conn.WriteJSON(wsMessage{Type: "error", Error: fmt.Sprintf("unknown control message type %q", msg.Type)})
+				}
+			case payload := <-subscription.EventChan:
+				if paused.hold(payload) {
+					continue
+				}
+				if err := send(payload); err != nil {
+					sentry.CaptureException(err)
+					log.Println("Error writing to WebSocket", err)
+					return nil
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+func TestCheckWebSocketOrigin(t *testing.T) {
+	setConfig(t, "websocket.allowed_origins", []string{"https://app.example.com"})
+
+	tests := []struct {
+		name   string
+		origin string
+		want   bool
+	}{
+		{name: "no origin", origin: "", want: true},
+		{name: "same origin", origin: "https://live.example.com", want: true},
+		{name: "allowed origin", origin: "https://app.example.com", want: true},
+		{name: "other origin", origin: "https://evil.example.net", want: false},
+		{name: "allowed host on another scheme", origin: "http://app.example.com", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "https://live.example.com/ws", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if got := checkWebSocketOrigin(req); got != tt.want {
+				t.Errorf("checkWebSocketOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+// dialWebSocket opens a WebSocket to a test server running handler at path.
+func dialWebSocket(t *testing.T, handler echo.HandlerFunc, path string) *websocket.Conn {
+	t.Helper()
+	e := echo.New()
+	e.GET("/ws", handler)
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, nil)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", path, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readWebSocket returns the next message, failing the test if none arrives.
+func readWebSocket(t *testing.T, conn *websocket.Conn) wsMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var msg wsMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("reading from WebSocket: %v", err)
+	}
+	return msg
+}
+
+func TestWebSocketUpdate(t *testing.T) {
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent))
+	subscribed := make(subscriptionNotifier, 2)
+	filter.SetObserver(subscribed)
+	go filter.Run()
+	t.Cleanup(filter.Stop)
+	handler := WebSocketHandler(filter, NewLifecycle(), NewAckRegistry())
+
+	updating := dialWebSocket(t, handler, "/ws?geo=true&eventType=before")
+	other := dialWebSocket(t, handler, "/ws?geo=true&eventType=before")
+	<-subscribed
+	<-subscribed
+
+	if err := updating.WriteJSON(wsControlMessage{Type: "update", EventTypes: []string{"after"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Control messages are handled in order, so once this one is answered
+	// the update has reached the filter.
+	updating.WriteJSON(wsControlMessage{Type: "sync"})
+	if msg := readWebSocket(t, updating); msg.Type != "error" {
+		t.Fatalf("got a %q message, want the error for the unknown type", msg.Type)
+	}
+
+	filter.inboundChan <- PostHogEvent{Token: "token", Event: "before", Lat: 1}
+	filter.inboundChan <- PostHogEvent{Token: "token", Event: "after", Lat: 2}
+
+	lat := func(msg wsMessage) float64 {
+		data, _ := msg.Data.(map[string]interface{})
+		lat, _ := data["lat"].(float64)
+		return lat
+	}
+	if msg := readWebSocket(t, updating); lat(msg) != 2 {
+		t.Errorf("updated client got %+v, want only the event matching its new filters", msg)
+	}
+	if msg := readWebSocket(t, other); lat(msg) != 1 {
+		t.Errorf("other client got %+v, want its filters untouched by the update", msg)
+	}
+}